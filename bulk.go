@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A single write to storage, as it's retried and dead-lettered. Exactly one of the
+// fields is set.
+type storageOp struct {
+	Item    *itemWrite    `json:"item,omitempty"`
+	Removal *itemRemoval  `json:"removal,omitempty"`
+	Mapping *mappingWrite `json:"mapping,omitempty"`
+}
+
+// Kinds of storage ops
+const (
+	opItem         = "item"
+	opStashMapping = "stash_mapping"
+	opRemoval      = "removal"
+)
+
+// kind returns whether the op writes an item, a stash mapping or an item's removal
+func (op storageOp) kind() string {
+	if op.Removal != nil {
+		return opRemoval
+	} else if op.Mapping != nil {
+		return opStashMapping
+	}
+	return opItem
+}
+
+// An op that storage refused to write, along with why
+type rejectedOp struct {
+	Op     storageOp
+	Status int
+	Error  writeError
+}
+
+// Why storage rejected a write, e.g. the error ES gave for a bulk item
+type writeError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// buildStorageOps lists the writes for an update: removals, then items, then the
+// mappings of the stashes they're in
+func buildStorageOps(update itemUpdate, date string) []storageOp {
+	var ops []storageOp
+
+	for _, removed := range update.deletes {
+		ops = append(ops, storageOp{Removal: &itemRemoval{
+			ID:         removed.ID,
+			League:     removed.League,
+			RemovedAt:  date,
+			TimeToSell: timeToSell(update.listedAt[removed], date),
+		}})
+	}
+
+	for _, stash := range update.stashes {
+		for _, item := range stash.FormattedItems {
+			item.Account = stash.AccountName
+			item.LastUpdated = date
+			chaos, _ := Rates.ToChaos(stash.League, item.PriceCurrency, float64(item.PricePerUnit))
+			item.PriceChaos = JSONFloat(chaos)
+			if item.create && item.CreatedAt == "" {
+				item.CreatedAt = date
+			}
+
+			// Blank out item.ID so it doesn't get indexed, then put it back for the sinks
+			id := item.ID
+			item.ID = ""
+			doc, _ := json.Marshal(item)
+			item.ID = id
+
+			ops = append(ops, storageOp{Item: &itemWrite{
+				ID:          id,
+				League:      stash.League,
+				Account:     item.Account,
+				CreatedAt:   item.CreatedAt,
+				LastUpdated: date,
+				Doc:         doc,
+			}})
+		}
+
+		ops = append(ops, storageOp{Mapping: &mappingWrite{
+			StashID: stash.ID,
+			Mapping: StashMapping{
+				LastUpdated: date,
+				League:      stash.League,
+				ItemIDs:     stash.ItemIDs,
+			},
+		}})
+	}
+
+	return ops
+}
+
+// chunkStorageOps splits an update's writes into chunks that can be written at the
+// same time
+func chunkStorageOps(update itemUpdate, date string) [][]storageOp {
+	var chunks [][]storageOp
+	numWorkers := 8
+	for i := 0; i < numWorkers; i++ {
+		updateChunk := itemUpdate{
+			stashes:  update.stashes[i*len(update.stashes)/numWorkers : (i+1)*len(update.stashes)/numWorkers],
+			deletes:  update.deletes[i*len(update.deletes)/numWorkers : (i+1)*len(update.deletes)/numWorkers],
+			listedAt: update.listedAt,
+		}
+		if ops := buildStorageOps(updateChunk, date); len(ops) > 0 {
+			chunks = append(chunks, ops)
+		}
+	}
+	return chunks
+}
+
+// persistBatch writes a batch's chunks in two phases: every removal, then every item and
+// mapping. An item that moved to another stash in the same batch is usually removed in
+// a different chunk than it's written in, so this keeps the removal from racing the
+// write and leaving the item marked as removed. It returns the ops that were
+// dead-lettered.
+func persistBatch(ctx context.Context, changeID string, chunks [][]storageOp) []storageOp {
+	var removals, writes [][]storageOp
+	for _, chunk := range chunks {
+		var removalOps, writeOps []storageOp
+		for _, op := range chunk {
+			if op.kind() == opRemoval {
+				removalOps = append(removalOps, op)
+			} else {
+				writeOps = append(writeOps, op)
+			}
+		}
+		if len(removalOps) > 0 {
+			removals = append(removals, removalOps)
+		}
+		if len(writeOps) > 0 {
+			writes = append(writes, writeOps)
+		}
+	}
+
+	deadLettered := persistWithRetry(ctx, changeID, removals)
+	return append(deadLettered, persistWithRetry(ctx, changeID, writes)...)
+}
+
+// timeToSell returns the seconds between an item being listed and removed, or 0 if
+// it's not known when it was listed
+func timeToSell(listedAt, removedAt string) int64 {
+	listed := parseOptionalDate(listedAt)
+	removed := parseOptionalDate(removedAt)
+	if listed == nil || removed == nil || removed.Before(*listed) {
+		return 0
+	}
+	return int64(removed.Sub(*listed) / time.Second)
+}
+
+// persistWithRetry writes chunks of ops, retrying failures with backoff. Actions
+// that still fail after maxPersistAttempts, or once ctx is cancelled, are moved to the
+// dead-letter queue, so this only returns once every action has either been persisted
+// or dead-lettered; if the queue can't take them either, it keeps backing off even
+// after ctx is cancelled. It returns the ops that were dead-lettered.
+func persistWithRetry(ctx context.Context, changeID string, chunks [][]storageOp) []storageOp {
+	// Chunks that failed outright are retried whole, while chunks that were
+	// partially rejected only retry their retryable items
+	failed, deadLettered := persistChunks(changeID, chunks)
+	for attempt := 1; len(failed) > 0; attempt++ {
+		if attempt >= maxPersistAttempts || ctx.Err() != nil {
+			var letters []deadLetter
+			for _, chunk := range failed {
+				for _, op := range chunk {
+					letters = append(letters, newDeadLetter(changeID, op, 0, writeError{
+						Type:   retriesExhausted,
+						Reason: fmt.Sprintf("failed to persist after %d attempts", attempt),
+					}))
+				}
+			}
+			if err := DeadLetters.Append(letters); err != nil {
+				fmt.Printf("Error dead-lettering failed chunks: %v\n", err)
+			} else {
+				fmt.Printf("Moved %d actions to the dead-letter queue after %d attempts\n", len(letters), attempt)
+				for _, chunk := range failed {
+					deadLettered = append(deadLettered, chunk...)
+				}
+				return deadLettered
+			}
+		}
+
+		// Once shutting down, getting here means dead-lettering failed too, so keep
+		// backing off rather than hammering storage and the queue
+		delay := backoffDelay(attempt)
+		fmt.Printf("%d chunks failed to persist, retrying in %v\n", len(failed), delay)
+		if ctx.Err() != nil {
+			time.Sleep(delay)
+		} else {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		var rejected []storageOp
+		failed, rejected = persistChunks(changeID, failed)
+		deadLettered = append(deadLettered, rejected...)
+	}
+	return deadLettered
+}
+
+// persistChunks writes each chunk of ops concurrently and returns the ops that need
+// to be retried, along with the ones that were dead-lettered
+func persistChunks(changeID string, chunks [][]storageOp) ([][]storageOp, []storageOp) {
+	retries := make([][]storageOp, len(chunks))
+	rejections := make([][]storageOp, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk []storageOp) {
+			defer wg.Done()
+			retry, rejected, err := persistItems(changeID, chunk)
+			if err != nil {
+				fmt.Printf("Error persisting items: %v\n", err)
+			}
+			retries[i] = retry
+			rejections[i] = rejected
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	var failed [][]storageOp
+	var deadLettered []storageOp
+	for i, retry := range retries {
+		if len(retry) > 0 {
+			failed = append(failed, retry)
+		}
+		deadLettered = append(deadLettered, rejections[i]...)
+	}
+	return failed, deadLettered
+}
+
+// persistItems writes a chunk of ops to storage and returns the ones that should be
+// retried. Ops that storage permanently rejected are moved to the dead-letter queue
+// and returned as well.
+func persistItems(changeID string, ops []storageOp) ([]storageOp, []storageOp, error) {
+	retry, rejected, err := writeOps(ops)
+	if err != nil {
+		return retry, nil, err
+	}
+
+	var deadLettered []storageOp
+
+	if len(rejected) > 0 {
+		letters := make([]deadLetter, 0, len(rejected))
+		for _, r := range rejected {
+			letters = append(letters, newDeadLetter(changeID, r.Op, r.Status, r.Error))
+		}
+		fmt.Printf("%d items were rejected, first error: %s: %s\n", len(letters), letters[0].Error.Type, letters[0].Error.Reason)
+		if err := DeadLetters.Append(letters); err != nil {
+			// Retry them rather than losing them
+			fmt.Printf("Error writing dead letters: %v\n", err)
+			for _, letter := range letters {
+				retry = append(retry, letter.Op)
+			}
+		} else {
+			for _, letter := range letters {
+				deadLettered = append(deadLettered, letter.Op)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		return retry, deadLettered, fmt.Errorf("%d of %d items need to be retried", len(retry), len(ops))
+	}
+
+	return nil, deadLettered, nil
+}
+
+// writeOps writes ops to storage by kind, returning the ones that can be retried and the
+// ones that were rejected. Removals go first, so an item that's removed and written in
+// the same chunk ends up listed; across a batch, persistBatch writes every removal
+// before any item. A kind that fails as a whole holds back the kinds after it, so
+// they're retried together in the same order.
+func writeOps(ops []storageOp) ([]storageOp, []rejectedOp, error) {
+	var removals []itemRemoval
+	var items []itemWrite
+	var mappings []mappingWrite
+	var removalOps, itemOps, mappingOps []storageOp
+	for _, op := range ops {
+		switch op.kind() {
+		case opRemoval:
+			removals = append(removals, *op.Removal)
+			removalOps = append(removalOps, op)
+		case opItem:
+			items = append(items, *op.Item)
+			itemOps = append(itemOps, op)
+		case opStashMapping:
+			mappings = append(mappings, *op.Mapping)
+			mappingOps = append(mappingOps, op)
+		}
+	}
+
+	steps := []struct {
+		ops   []storageOp
+		write func() ([]writeFailure, error)
+	}{
+		{removalOps, func() ([]writeFailure, error) { return Store.RemoveItems(removals) }},
+		{itemOps, func() ([]writeFailure, error) { return Store.UpsertItems(items) }},
+		{mappingOps, func() ([]writeFailure, error) { return Store.SaveStashMappings(mappings) }},
+	}
+
+	var retry []storageOp
+	var rejected []rejectedOp
+	for i, step := range steps {
+		if len(step.ops) == 0 {
+			continue
+		}
+		failures, err := step.write()
+		if err != nil {
+			for _, held := range steps[i:] {
+				retry = append(retry, held.ops...)
+			}
+			return retry, rejected, err
+		}
+		for _, f := range failures {
+			if f.Retryable {
+				retry = append(retry, step.ops[f.Index])
+			} else {
+				rejected = append(rejected, rejectedOp{Op: step.ops[f.Index], Status: f.Status, Error: f.Error})
+			}
+		}
+	}
+	return retry, rejected, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistItemsPartialFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBulkBody(t, r)
+		if strings.HasPrefix(body, `{"update"`) {
+			fmt.Fprint(w, `{"errors": true, "items": [
+				{"update": {"status": 404, "error": {"type": "document_missing_exception", "reason": "document missing"}}}
+			]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors": true, "items": [
+			{"index": {"status": 201}},
+			{"index": {"status": 429, "error": {"type": "es_rejected_execution_exception", "reason": "queue full"}}},
+			{"index": {"status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse field [ilvl]"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	ESURL = server.URL + "/"
+	Store = newElasticsearchStorage(server.Client())
+	dlq, err := openDeadLetterQueue(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	DeadLetters = dlq
+
+	ops := []storageOp{
+		{Removal: &itemRemoval{ID: "removed", League: "Sentinel", RemovedAt: "2022-05-20T00:00:00+0000"}},
+		{Item: &itemWrite{ID: "ok", League: "Sentinel", Doc: []byte(`{}`)}},
+		{Item: &itemWrite{ID: "throttled", League: "Sentinel", Doc: []byte(`{}`)}},
+		{Item: &itemWrite{ID: "bad", League: "Sentinel", Doc: []byte(`{"ilvl":"x"}`)}},
+	}
+	retry, deadLettered, err := persistItems("1-2-3", ops)
+	require.Error(t, err)
+	require.Equal(t, []storageOp{ops[2]}, retry)
+	require.Equal(t, []storageOp{ops[3]}, deadLettered)
+	require.NoError(t, dlq.Close())
+
+	// With a max age of 0 the file is sealed as soon as it's written
+	files, err := dlq.Sealed()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	letters, err := readDeadLetters(files[0])
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	require.Equal(t, "bad", letters[0].Op.Item.ID)
+	require.Equal(t, "1-2-3", letters[0].ChangeID)
+	require.Equal(t, opItem, letters[0].Kind)
+	require.Equal(t, 400, letters[0].Status)
+	require.Equal(t, "mapper_parsing_exception", letters[0].Error.Type)
+}
+
+func TestWriteOpsOrder(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := readBulkBody(t, r)
+		received = append(received, body)
+		if strings.Contains(body, `"_index":"items-sentinel"`) && !strings.HasPrefix(body, `{"update"`) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"errors": false}`)
+	}))
+	defer server.Close()
+
+	ESURL = server.URL + "/"
+	Store = newElasticsearchStorage(server.Client())
+
+	ops := buildStorageOps(itemUpdate{
+		stashes: []PlayerStash{testStash(t, "item1")},
+		deletes: []itemRef{{ID: "item2", League: "Sentinel"}},
+	}, "2022-05-20T00:00:00+0000")
+
+	// Removals are written first, and the mapping waits on the items that failed
+	retry, rejected, err := writeOps(ops)
+	require.Error(t, err)
+	require.Empty(t, rejected)
+	require.Len(t, received, 2)
+	require.True(t, strings.HasPrefix(received[0], `{"update":{"_index":"items-sentinel","_id":"item2"}}`))
+	require.Equal(t, []string{opItem, opStashMapping}, []string{retry[0].kind(), retry[1].kind()})
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "_mget") {
+			// item3 has been updated since its write was dead-lettered
+			fmt.Fprint(w, `{"docs": [{"_id": "item3", "found": true, "_source": {"last_updated": "2022-05-21T00:00:00+0000"}}]}`)
+			return
+		}
+		received = append(received, readBulkBody(t, r))
+		fmt.Fprint(w, `{"errors": false}`)
+	}))
+	defer server.Close()
+
+	ESURL = server.URL + "/"
+	Store = newElasticsearchStorage(server.Client())
+	dlq, err := openDeadLetterQueue(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	DeadLetters = dlq
+
+	item := storageOp{Item: &itemWrite{ID: "item1", League: "Sentinel", LastUpdated: "2022-05-20T00:00:00+0000", Doc: []byte(`{"ilvl":1}`)}}
+	removal := storageOp{Removal: &itemRemoval{ID: "item2", League: "Sentinel", RemovedAt: "2022-05-20T00:00:00+0000"}}
+	stale := storageOp{Item: &itemWrite{ID: "item3", League: "Sentinel", LastUpdated: "2022-05-20T00:00:00+0000", Doc: []byte(`{"ilvl":2}`)}}
+	require.NoError(t, dlq.Append([]deadLetter{
+		newDeadLetter("1-1-1", item, 400, writeError{Type: "mapper_parsing_exception"}),
+		newDeadLetter("1-1-1", stale, 400, writeError{Type: "mapper_parsing_exception"}),
+		newDeadLetter("2-2-2", removal, 0, writeError{Type: retriesExhausted}),
+	}))
+	require.NoError(t, dlq.Close())
+
+	require.NoError(t, replayDeadLetters(context.Background(), dlq))
+	require.Equal(t, []string{
+		`{"index":{"_index":"items-sentinel","_id":"item1"}}` + "\n" + `{"ilvl":1}` + "\n",
+		`{"update":{"_index":"items-sentinel","_id":"item2"}}` + "\n" + `{"doc":{"removed_at":"2022-05-20T00:00:00+0000"}}` + "\n",
+	}, received)
+
+	files, err := dlq.Sealed()
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestFreshDeadLetters(t *testing.T) {
+	Store = newMemoryStorage()
+	_, err := Store.UpsertItems([]itemWrite{
+		{ID: "moved", League: "Sentinel", Doc: []byte(`{"last_updated":"2022-05-20T00:00:00+0000"}`)},
+		{ID: "updated", League: "Sentinel", Doc: []byte(`{"last_updated":"2022-05-21T00:00:00+0000"}`)},
+	})
+	require.NoError(t, err)
+	_, err = Store.SaveStashMappings([]mappingWrite{{StashID: "stash1", Mapping: StashMapping{LastUpdated: "2022-05-21T00:00:00+0000"}}})
+	require.NoError(t, err)
+
+	letter := func(op storageOp) deadLetter {
+		return newDeadLetter("1-1-1", op, 0, writeError{Type: retriesExhausted})
+	}
+	fresh := []storageOp{
+		{Item: &itemWrite{ID: "new", League: "Sentinel", LastUpdated: "2022-05-20T00:00:00+0000"}},
+		{Item: &itemWrite{ID: "updated", League: "Sentinel", LastUpdated: "2022-05-22T00:00:00+0000"}},
+		{Mapping: &mappingWrite{StashID: "stash2", Mapping: StashMapping{LastUpdated: "2022-05-20T00:00:00+0000"}}},
+	}
+	ops, err := freshDeadLetters([]deadLetter{
+		// The item's relisting in the same batch was dead-lettered along with its removal
+		letter(storageOp{Removal: &itemRemoval{ID: "new", League: "Sentinel", RemovedAt: "2022-05-20T00:00:00+0000"}}),
+		letter(fresh[0]),
+		letter(fresh[1]),
+		letter(fresh[2]),
+		letter(storageOp{Item: &itemWrite{ID: "updated", League: "Sentinel", LastUpdated: "2022-05-20T00:00:00+0000"}}),
+		// The item was listed again in the same batch it was removed in
+		letter(storageOp{Removal: &itemRemoval{ID: "moved", League: "Sentinel", RemovedAt: "2022-05-20T00:00:00+0000"}}),
+		letter(storageOp{Mapping: &mappingWrite{StashID: "stash1", Mapping: StashMapping{LastUpdated: "2022-05-20T00:00:00+0000"}}}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, fresh, ops)
+}
+
+// readBulkBody returns the uncompressed body of a _bulk request
+func readBulkBody(t *testing.T, r *http.Request) string {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		t.Errorf("reading bulk request: %v", err)
+		return ""
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Errorf("reading bulk request: %v", err)
+	}
+	return string(body)
+}
+
+func TestPersistWithRetryAfterShutdown(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	ESURL = server.URL + "/"
+	Store = newElasticsearchStorage(server.Client())
+	dlq, err := openDeadLetterQueue(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	DeadLetters = dlq
+
+	// Once shutting down, failures are dead-lettered instead of backing off
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	op := storageOp{Item: &itemWrite{ID: "item1", League: "Sentinel", Doc: []byte(`{}`)}}
+	deadLettered := persistWithRetry(ctx, "1-1-1", [][]storageOp{{op}})
+	require.Equal(t, 1, requests)
+	require.Equal(t, []storageOp{op}, deadLettered)
+	require.NoError(t, dlq.Close())
+
+	files, err := dlq.Sealed()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	letters, err := readDeadLetters(files[0])
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	require.Equal(t, retriesExhausted, letters[0].Error.Type)
+}
+
+func TestBuildBulkOpsTimeToSell(t *testing.T) {
+	sold := itemRef{ID: "item1", League: "Sentinel"}
+	unknown := itemRef{ID: "item2", League: "Sentinel"}
+	update := itemUpdate{
+		deletes:  []itemRef{sold, unknown},
+		listedAt: map[itemRef]string{sold: "2022-05-19T23:00:00+0000"},
+	}
+
+	ops := buildStorageOps(update, "2022-05-20T00:00:00+0000")
+	require.Len(t, ops, 2)
+	require.Equal(t, itemRemoval{ID: "item1", League: "Sentinel", RemovedAt: "2022-05-20T00:00:00+0000", TimeToSell: 3600}, *ops[0].Removal)
+	require.Equal(t, int64(0), ops[1].Removal.TimeToSell)
+}
+
+// slowRemovalStorage delays removals, so they'd finish after any writes that race them
+type slowRemovalStorage struct {
+	*memoryStorage
+}
+
+func (s slowRemovalStorage) RemoveItems(removals []itemRemoval) ([]writeFailure, error) {
+	time.Sleep(50 * time.Millisecond)
+	return s.memoryStorage.RemoveItems(removals)
+}
+
+func TestPersistBatchMovedItem(t *testing.T) {
+	memory := newMemoryStorage()
+	Store = slowRemovalStorage{memory}
+	Fingerprints = nil
+	require.NoError(t, Store.EnsureLeague("Sentinel"))
+	persistTestStashes(t, []PlayerStash{testStash(t, "item1")})
+
+	// item1 moves from stash1 to stash2, which is in the first chunk while its
+	// removal from stash1 is in the last
+	moved := testStash(t, "item1")
+	moved.ID = "stash2"
+	moved.FormattedItems[0].create = true
+	stashes := []PlayerStash{moved}
+	for i := 0; i < 7; i++ {
+		stash := testStash(t)
+		stash.ID = fmt.Sprintf("empty%d", i)
+		stashes = append(stashes, stash)
+	}
+	update := itemUpdate{stashes: stashes, deletes: []itemRef{{ID: "item1", League: "Sentinel"}}}
+	chunks := chunkStorageOps(update, "2022-05-21T00:00:00+0000")
+	require.Equal(t, opItem, chunks[0][0].kind())
+	require.Equal(t, opRemoval, chunks[len(chunks)-1][0].kind())
+
+	require.Empty(t, persistBatch(context.Background(), "2-2-2", chunks))
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(memory.items[itemRef{ID: "item1", League: "Sentinel"}], &doc))
+	require.Nil(t, doc["removed_at"])
+}
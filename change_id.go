@@ -2,44 +2,25 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 )
 
-func getChangeID(client *http.Client) (string, error) {
-	req, err := http.NewRequest("GET", ESURL+"next-change-id/_doc/0", nil)
-	if err != nil {
-		return "", err
-	}
-
-	setBasicAuth(req)
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		log.Printf("Error: status code %d", resp.StatusCode)
-		log.Printf("Headers: %v", resp.Header)
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Println("Response Body:", string(body))
-		return "", fmt.Errorf("Unexpected status code %d", resp.StatusCode)
-	}
-
-	body, _ := ioutil.ReadAll(resp.Body)
-	type changeResp struct {
+// getChangeID returns the stored change ID, or "" if none has been saved yet, e.g. on
+// a fresh cluster where the index doesn't exist
+func getChangeID() (string, error) {
+	var doc struct {
 		Source map[string]string `json:"_source"`
 	}
-	var cr changeResp
-	if err := json.Unmarshal(body, &cr); err != nil {
+	err := doElasticsearchRequest("GET", "next-change-id/_doc/0", nil, &doc)
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
 		return "", err
 	}
-
-	return cr.Source["next_change_id"], nil
+	return doc.Source["next_change_id"], nil
 }
 
 func persistChangeID(client *http.Client, nextChangeID string) error {
@@ -58,7 +58,7 @@ func alertOnExpensiveSoldItems(duplicates map[string]bool, minTime time.Time) ma
 
 	body := bytes.NewBufferString(query)
 	var resp ItemQueryResponse
-	if err := doElasticsearchRequest("GET", "items-archnemesis/_search", body, &resp); err != nil {
+	if err := doElasticsearchRequest("GET", itemIndexPrefix+"-*/_search", body, &resp); err != nil {
 		fmt.Println("Error running expensive item query:", err)
 		return duplicates
 	}
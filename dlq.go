@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deadLetterPrefix     = "dead-letters-"
+	deadLetterExt        = ".ndjson"
+	deadLetterTimeFormat = "20060102T150405.000000000"
+
+	// Dead-lettered actions are resubmitted in chunks of this size
+	deadLetterReplayChunk = 500
+)
+
+// Error type recorded for actions that were dead-lettered after running out of retries
+const retriesExhausted = "retries_exhausted"
+
+// DeadLetters is the dead-letter queue used by the indexer, set up in main
+var DeadLetters *deadLetterQueue
+
+// A write that storage rejected, along with why and which batch it came from
+type deadLetter struct {
+	Time     time.Time  `json:"time"`
+	ChangeID string     `json:"change_id"`
+	Kind     string     `json:"kind"`
+	Op       storageOp  `json:"op"`
+	Status   int        `json:"status,omitempty"`
+	Error    writeError `json:"error"`
+}
+
+func newDeadLetter(changeID string, op storageOp, status int, err writeError) deadLetter {
+	return deadLetter{
+		Time:     time.Now(),
+		ChangeID: changeID,
+		Kind:     op.kind(),
+		Op:       op,
+		Status:   status,
+		Error:    err,
+	}
+}
+
+// deadLetterQueue is an append-only log of rejected documents, split across files in
+// a directory. Each file is only written to for maxAge after it's created, which lets
+// a replay safely consume files older than that while the indexer is running.
+type deadLetterQueue struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	opened time.Time
+	size   int64
+}
+
+func openDeadLetterQueue(dir string, maxBytes int64, maxAge time.Duration) (*deadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &deadLetterQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}, nil
+}
+
+// Append writes dead letters to the current log file, rotating to a new file first if
+// the current one is too big or too old
+func (q *deadLetterQueue) Append(letters []deadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil || q.size >= q.maxBytes || time.Since(q.opened) >= q.maxAge {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(q.f)
+	for _, letter := range letters {
+		b, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		n, err := w.Write(append(b, '\n'))
+		q.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return q.f.Sync()
+}
+
+// Must be called with q.mu held
+func (q *deadLetterQueue) rotate() error {
+	if q.f != nil {
+		if err := q.f.Close(); err != nil {
+			return err
+		}
+		q.f = nil
+	}
+
+	now := time.Now().UTC()
+	path := filepath.Join(q.dir, deadLetterPrefix+now.Format(deadLetterTimeFormat)+deadLetterExt)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	q.f = f
+	q.opened = now
+	q.size = 0
+	return nil
+}
+
+// Close closes the current log file
+func (q *deadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.f == nil {
+		return nil
+	}
+	err := q.f.Close()
+	q.f = nil
+	return err
+}
+
+// Sealed returns the log files, oldest first, that are old enough that nothing will
+// write to them anymore
+func (q *deadLetterQueue) Sealed() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, deadLetterPrefix+"*"+deadLetterExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	q.mu.Lock()
+	current := ""
+	if q.f != nil {
+		current = q.f.Name()
+	}
+	q.mu.Unlock()
+
+	var sealed []string
+	for _, path := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), deadLetterPrefix), deadLetterExt)
+		opened, err := time.Parse(deadLetterTimeFormat, name)
+		if err != nil || path == current || time.Since(opened) < q.maxAge {
+			continue
+		}
+		sealed = append(sealed, path)
+	}
+	return sealed, nil
+}
+
+func readDeadLetters(path string) ([]deadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var letters []deadLetter
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var letter deadLetter
+		if err := dec.Decode(&letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// replayDeadLetters resubmits every sealed dead-letter file to storage, removing each
+// file once its writes have been persisted. Writes that storage has newer state for are
+// skipped, and writes that are rejected again go back into the queue.
+func replayDeadLetters(ctx context.Context, q *deadLetterQueue) error {
+	files, err := q.Sealed()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Replaying %d dead-letter files from %s\n", len(files), q.dir)
+	for _, path := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		letters, err := readDeadLetters(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+
+		// Keep each chunk to a single change ID so anything that fails again is
+		// dead-lettered with the batch it came from
+		skipped := 0
+		for start := 0; start < len(letters); {
+			changeID := letters[start].ChangeID
+			end := start
+			for end < len(letters) && letters[end].ChangeID == changeID && end-start < deadLetterReplayChunk {
+				end++
+			}
+
+			chunk, err := freshDeadLetters(letters[start:end])
+			if err != nil {
+				return fmt.Errorf("looking up state for %s: %v", path, err)
+			}
+			skipped += end - start - len(chunk)
+			if len(chunk) > 0 {
+				persistWithRetry(ctx, changeID, [][]storageOp{chunk})
+			}
+			start = end
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		fmt.Printf("Replayed %d dead letters from %s, skipping %d that storage has newer state for\n", len(letters)-skipped, path, skipped)
+	}
+
+	return nil
+}
+
+// freshDeadLetters returns the ops of the letters that storage hasn't moved past since
+// they were dead-lettered. Replaying the others would overwrite newer state, e.g. an
+// item that was updated again after its write was rejected.
+func freshDeadLetters(letters []deadLetter) ([]storageOp, error) {
+	refsByLeague := make(map[string][]itemRef)
+	var stashIDs []string
+	for _, letter := range letters {
+		switch letter.Op.kind() {
+		case opItem:
+			item := letter.Op.Item
+			refsByLeague[item.League] = append(refsByLeague[item.League], itemRef{ID: item.ID, League: item.League})
+		case opRemoval:
+			removal := letter.Op.Removal
+			refsByLeague[removal.League] = append(refsByLeague[removal.League], itemRef{ID: removal.ID, League: removal.League})
+		case opStashMapping:
+			stashIDs = append(stashIDs, letter.Op.Mapping.StashID)
+		}
+	}
+
+	itemUpdated := make(map[itemRef]string)
+	for league, refs := range refsByLeague {
+		items, err := Store.LookupItems(refs)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			itemUpdated[itemRef{ID: item.ID, League: league}] = item.LastUpdated
+		}
+	}
+	mappings := map[string]StashMapping{}
+	if len(stashIDs) > 0 {
+		var err error
+		if mappings, err = Store.LookupStashMappings(stashIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	// When the letters themselves write each item, so removals can be checked against
+	// them as well as against storage
+	letterUpdated := make(map[itemRef]string)
+	for _, letter := range letters {
+		if item := letter.Op.Item; item != nil {
+			ref := itemRef{ID: item.ID, League: item.League}
+			if letterUpdated[ref] == "" || storedAfter(item.LastUpdated, letterUpdated[ref], false) {
+				letterUpdated[ref] = item.LastUpdated
+			}
+		}
+	}
+
+	var ops []storageOp
+	for _, letter := range letters {
+		op := letter.Op
+		switch op.kind() {
+		case opItem:
+			if storedAfter(itemUpdated[itemRef{ID: op.Item.ID, League: op.Item.League}], op.Item.LastUpdated, false) {
+				continue
+			}
+		case opRemoval:
+			// Items are only written while they're in a stash, so one written at or
+			// after its removal, including in the same batch, is listed again. That
+			// holds whichever order the writes reached storage in.
+			ref := itemRef{ID: op.Removal.ID, League: op.Removal.League}
+			if storedAfter(itemUpdated[ref], op.Removal.RemovedAt, true) || storedAfter(letterUpdated[ref], op.Removal.RemovedAt, true) {
+				continue
+			}
+		case opStashMapping:
+			if storedAfter(mappings[op.Mapping.StashID].LastUpdated, op.Mapping.Mapping.LastUpdated, false) {
+				continue
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// storedAfter returns whether the stored last_updated is later than a letter's date, or
+// the same if orEqual is set. Dates that are missing or can't be parsed never count.
+func storedAfter(stored, letter string, orEqual bool) bool {
+	storedTime := parseOptionalDate(stored)
+	letterTime := parseOptionalDate(letter)
+	if storedTime == nil || letterTime == nil {
+		return false
+	}
+	return storedTime.After(*letterTime) || (orEqual && storedTime.Equal(*letterTime))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of item lifecycle events
+const (
+	eventItemListed   = "item_listed"
+	eventItemRepriced = "item_repriced"
+	eventItemUpdated  = "item_updated"
+	eventItemRemoved  = "item_removed"
+	eventStashCleared = "stash_cleared"
+)
+
+const (
+	eventLogPrefix = "events-"
+	eventLogExt    = ".ndjson"
+)
+
+// itemEvent is a single change to an item or stash. The schema is stable: fields may
+// be added, but existing ones won't change meaning. Seq is only set by the event log.
+// The item is described by its own fixed set of fields rather than the indexed
+// document, which changes along with what gets indexed.
+type itemEvent struct {
+	Seq       uint64     `json:"seq,omitempty"`
+	Type      string     `json:"type"`
+	Time      time.Time  `json:"time"`
+	ChangeID  string     `json:"change_id"`
+	League    string     `json:"league"`
+	StashID   string     `json:"stash_id,omitempty"`
+	Account   string     `json:"account,omitempty"`
+	ItemID    string     `json:"item_id,omitempty"`
+	Price     *itemPrice `json:"price,omitempty"`
+	PrevPrice *itemPrice `json:"prev_price,omitempty"`
+	Item      *eventItem `json:"item,omitempty"`
+}
+
+// The item an event is about, as listed
+type eventItem struct {
+	Name       string `json:"name,omitempty"`
+	TypeLine   string `json:"type_line"`
+	BaseType   string `json:"base_type,omitempty"`
+	FrameType  int    `json:"frame_type"`
+	ItemLevel  int    `json:"item_level,omitempty"`
+	StackSize  int    `json:"stack_size,omitempty"`
+	Identified bool   `json:"identified"`
+	Corrupted  bool   `json:"corrupted"`
+	Note       string `json:"note,omitempty"`
+	X          int    `json:"x"`
+	Y          int    `json:"y"`
+}
+
+func newEventItem(item *IndexedItem) *eventItem {
+	return &eventItem{
+		Name:       item.Name,
+		TypeLine:   item.TypeLine,
+		BaseType:   item.BaseType,
+		FrameType:  item.FrameType,
+		ItemLevel:  item.Ilvl,
+		StackSize:  item.StackSize,
+		Identified: item.Identified,
+		Corrupted:  item.Corrupted,
+		Note:       item.Note,
+		X:          item.X,
+		Y:          item.Y,
+	}
+}
+
+// buildItemEvents derives the lifecycle events for a persisted batch. Removals come
+// first, matching the order they're written to storage.
+func buildItemEvents(batch persistedBatch) []itemEvent {
+	var events []itemEvent
+	for _, removed := range batch.Deletes {
+		events = append(events, itemEvent{
+			Type:     eventItemRemoved,
+			Time:     batch.Time,
+			ChangeID: batch.ChangeID,
+			League:   removed.League,
+			ItemID:   removed.ID,
+		})
+	}
+
+	for _, stash := range batch.Stashes {
+		for _, item := range stash.FormattedItems {
+			event := itemEvent{
+				Type:     eventItemUpdated,
+				Time:     batch.Time,
+				ChangeID: batch.ChangeID,
+				League:   stash.League,
+				StashID:  stash.ID,
+				Account:  stash.AccountName,
+				ItemID:   item.ID,
+				Item:     newEventItem(item),
+			}
+			if item.PriceCurrency != "" {
+				event.Price = &itemPrice{Value: item.PriceValue, Currency: item.PriceCurrency}
+			}
+
+			if item.create {
+				event.Type = eventItemListed
+			} else {
+				event.PrevPrice = item.prevPrice
+				if !item.contentChanged && item.prevPrice != nil {
+					event.Type = eventItemRepriced
+				}
+			}
+			events = append(events, event)
+		}
+	}
+
+	for _, stash := range batch.Cleared {
+		events = append(events, itemEvent{
+			Type:     eventStashCleared,
+			Time:     batch.Time,
+			ChangeID: batch.ChangeID,
+			League:   stash.League,
+			StashID:  stash.ID,
+		})
+	}
+
+	return events
+}
+
+// eventLog writes item events to NDJSON files in a directory, starting a new file once
+// the current one reaches maxBytes. Files are named after the sequence number of their
+// first event, and numbering picks up from the last event in the log after a restart.
+// Batches that are replayed after a crash get logged again with new sequence numbers.
+type eventLog struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	nextSeq uint64
+}
+
+func openEventLog(dir string, maxBytes int64, maxFiles int) (*eventLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &eventLog{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles, nextSeq: 1}
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		lastSeq, err := recoverEventLogFile(files[len(files)-1])
+		if err != nil {
+			return nil, err
+		}
+		if lastSeq > 0 {
+			l.nextSeq = lastSeq + 1
+		} else {
+			// The last file has no complete events, so carry on from its name
+			l.nextSeq = eventLogFileSeq(files[len(files)-1])
+		}
+	}
+	return l, nil
+}
+
+// recoverEventLogFile cuts off a partially written event at the end of a log file,
+// e.g. from a crash mid-write, and returns the sequence number of the last whole event
+func recoverEventLogFile(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	complete := bytes.LastIndexByte(b, '\n') + 1
+	if complete < len(b) {
+		fmt.Printf("Truncating a partial event at the end of %s\n", path)
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return 0, err
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(b[:complete]), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return 0, nil
+	}
+	var event itemEvent
+	if err := json.Unmarshal(last, &event); err != nil {
+		return 0, fmt.Errorf("reading last event in %s: %v", path, err)
+	}
+	return event.Seq, nil
+}
+
+func (l *eventLog) WriteBatch(batch persistedBatch) error {
+	events := buildItemEvents(batch)
+	if len(events) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil || l.size >= l.maxBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// Sequence numbers only advance once the whole batch is written, so a failed
+	// write doesn't leave a gap. The buffer gets flushed as it fills up, so whatever
+	// part of the batch reached the file is cut off again, leaving no duplicate or
+	// torn events behind when the batch is retried.
+	seq, written, err := l.writeEvents(events)
+	if err != nil {
+		if truncErr := l.truncate(); truncErr != nil {
+			fmt.Printf("Error cutting off a failed batch in the event log: %v\n", truncErr)
+		}
+		return err
+	}
+
+	l.size += written
+	l.nextSeq = seq
+	return nil
+}
+
+// writeEvents numbers and writes events to the current file, returning the next
+// sequence number and how many bytes were written. Must be called with l.mu held.
+func (l *eventLog) writeEvents(events []itemEvent) (uint64, int64, error) {
+	seq := l.nextSeq
+	w := bufio.NewWriter(l.f)
+	var written int64
+	for i := range events {
+		events[i].Seq = seq
+		seq++
+		b, err := json.Marshal(events[i])
+		if err != nil {
+			return 0, 0, err
+		}
+		n, err := w.Write(append(b, '\n'))
+		written += int64(n)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return 0, 0, err
+	}
+	return seq, written, nil
+}
+
+// truncate cuts the current file back to the end of the last batch that was written
+// in full. Must be called with l.mu held.
+func (l *eventLog) truncate() error {
+	if err := l.f.Truncate(l.size); err != nil {
+		return err
+	}
+	_, err := l.f.Seek(l.size, io.SeekStart)
+	return err
+}
+
+// Must be called with l.mu held
+func (l *eventLog) rotate() error {
+	if l.f != nil {
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+		l.f = nil
+	}
+
+	path := filepath.Join(l.dir, fmt.Sprintf("%s%020d%s", eventLogPrefix, l.nextSeq, eventLogExt))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = size
+
+	return l.prune()
+}
+
+// prune removes the oldest files beyond maxFiles, if there's a limit
+func (l *eventLog) prune() error {
+	if l.maxFiles <= 0 {
+		return nil
+	}
+	files, err := l.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > l.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// files returns the log's files, oldest first
+func (l *eventLog) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, eventLogPrefix+"*"+eventLogExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Close closes the current log file
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// eventLogFileSeq returns the sequence number a log file starts at, from its name
+func eventLogFileSeq(path string) uint64 {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), eventLogPrefix), eventLogExt)
+	seq, _ := strconv.ParseUint(name, 10, 64)
+	return seq
+}
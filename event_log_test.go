@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func eventTypes(events []itemEvent) []string {
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestBuildItemEvents(t *testing.T) {
+	Store = newMemoryStorage()
+	Fingerprints = nil
+	batch := func(stash PlayerStash) persistedBatch {
+		update := persistTestStashes(t, []PlayerStash{stash})
+		return persistedBatch{ChangeID: "1-1-1", Time: time.Now(), Stashes: update.stashes, Deletes: update.deletes, Cleared: update.cleared}
+	}
+
+	events := buildItemEvents(batch(testStash(t, "item1", "item2")))
+	require.Equal(t, []string{eventItemListed, eventItemListed}, eventTypes(events))
+	require.Equal(t, "item1", events[0].ItemID)
+	require.Equal(t, "stash1", events[0].StashID)
+	require.Equal(t, &itemPrice{Value: 15, Currency: "chaos"}, events[0].Price)
+
+	stash := testStash(t, "item1", "item2")
+	stash.FormattedItems[0].PriceValue = 20
+	stash.FormattedItems[1].X = 3
+	events = buildItemEvents(batch(stash))
+	require.Equal(t, []string{eventItemRepriced, eventItemUpdated}, eventTypes(events))
+	require.Equal(t, &itemPrice{Value: 20, Currency: "chaos"}, events[0].Price)
+	require.Equal(t, &itemPrice{Value: 15, Currency: "chaos"}, events[0].PrevPrice)
+	require.Nil(t, events[1].PrevPrice)
+
+	events = buildItemEvents(batch(testStash(t)))
+	require.Equal(t, []string{eventItemRemoved, eventItemRemoved, eventStashCleared}, eventTypes(events))
+	require.Equal(t, "Sentinel", events[2].League)
+	require.Equal(t, "stash1", events[2].StashID)
+}
+
+func TestEventLog(t *testing.T) {
+	dir := t.TempDir()
+	log, err := openEventLog(dir, 1, 0)
+	require.NoError(t, err)
+
+	batch := persistedBatch{
+		ChangeID: "1-1-1",
+		Time:     time.Now(),
+		Deletes:  []itemRef{{ID: "item1", League: "Sentinel"}, {ID: "item2", League: "Sentinel"}},
+	}
+	require.NoError(t, log.WriteBatch(batch))
+	require.NoError(t, log.WriteBatch(batch))
+	require.NoError(t, log.Close())
+
+	// Each batch went over the size limit, so the second one started a new file
+	files, err := log.files()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.Equal(t, uint64(3), eventLogFileSeq(files[1]))
+
+	// A partially written event is cut off and numbering carries on after the last
+	// complete one
+	f, err := os.OpenFile(files[1], os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"seq":5,"type":"item_rem`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	log, err = openEventLog(dir, 1<<20, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), log.nextSeq)
+	require.NoError(t, log.WriteBatch(batch))
+	require.NoError(t, log.Close())
+
+	// Writing after a restart starts a new file, and only the newest file is kept
+	files, err = filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	f, err = os.Open(files[0])
+	require.NoError(t, err)
+	defer f.Close()
+	var seqs []uint64
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var event itemEvent
+		require.NoError(t, dec.Decode(&event))
+		seqs = append(seqs, event.Seq)
+	}
+	require.Equal(t, []uint64{5, 6}, seqs)
+}
+
+func TestEventLogFailedWrite(t *testing.T) {
+	log, err := openEventLog(t.TempDir(), 1<<20, 0)
+	require.NoError(t, err)
+	defer log.Close()
+
+	batch := persistedBatch{ChangeID: "1-1-1", Time: time.Now(), Deletes: []itemRef{{ID: "item1", League: "Sentinel"}}}
+	require.NoError(t, log.WriteBatch(batch))
+	size := log.size
+
+	// Enough events to flush part of the batch before an item that can't be encoded
+	var deletes []itemRef
+	for i := 0; i < 100; i++ {
+		deletes = append(deletes, itemRef{ID: fmt.Sprintf("removed%d", i), League: "Sentinel"})
+	}
+	bad := &IndexedItem{PriceValue: JSONFloat(math.NaN()), PriceCurrency: "chaos"}
+	failed := persistedBatch{
+		ChangeID: "2-2-2",
+		Time:     time.Now(),
+		Deletes:  deletes,
+		Stashes:  []PlayerStash{{ID: "stash1", League: "Sentinel", FormattedItems: []*IndexedItem{bad}}},
+	}
+	require.Error(t, log.WriteBatch(failed))
+
+	// Nothing from the failed batch is left behind, and numbering carries on from the
+	// last whole batch
+	info, err := log.f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+	require.NoError(t, log.WriteBatch(batch))
+
+	b, err := os.ReadFile(log.f.Name())
+	require.NoError(t, err)
+	var seqs []uint64
+	for _, line := range bytes.Split(bytes.TrimSpace(b), []byte("\n")) {
+		var event itemEvent
+		require.NoError(t, json.Unmarshal(line, &event))
+		seqs = append(seqs, event.Seq)
+	}
+	require.Equal(t, []uint64{1, 2}, seqs)
+}
+
+func TestItemEventSchema(t *testing.T) {
+	item := testStash(t, "item1").FormattedItems[0]
+	item.ContentHash = "abc"
+	b, err := json.Marshal(itemEvent{Type: eventItemListed, Item: newEventItem(item)})
+	require.NoError(t, err)
+
+	// Only the event's own item fields are sent, not the indexed document
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &event))
+	eventItem := event["item"].(map[string]interface{})
+	require.Equal(t, "Rapture Nock", eventItem["name"])
+	require.Equal(t, "Ranger Bow", eventItem["type_line"])
+	require.NotContains(t, eventItem, "content_hash")
+	require.NotContains(t, eventItem, "explicitMods")
+}
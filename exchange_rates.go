@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rates converts listed prices to chaos, set up in main
+var Rates *exchangeRates
+
+// Chaos values to fall back on for a currency until enough of its listings have been seen
+var defaultChaosValues = map[string]float64{
+	"chaos":   1,
+	"exalted": 127,
+	"mirror":  23275,
+}
+
+// The names price notes use for currency items, keyed by the item's type line
+var currencyNoteNames = map[string]string{
+	"Chaos Orb":             "chaos",
+	"Divine Orb":            "divine",
+	"Exalted Orb":           "exalted",
+	"Mirror of Kalandra":    "mirror",
+	"Orb of Alchemy":        "alch",
+	"Orb of Fusing":         "fusing",
+	"Orb of Alteration":     "alt",
+	"Jeweller's Orb":        "jewellers",
+	"Chromatic Orb":         "chrome",
+	"Orb of Chance":         "chance",
+	"Orb of Regret":         "regret",
+	"Orb of Scouring":       "scour",
+	"Orb of Annulment":      "annul",
+	"Regal Orb":             "regal",
+	"Vaal Orb":              "vaal",
+	"Blessed Orb":           "blessed",
+	"Gemcutter's Prism":     "gcp",
+	"Cartographer's Chisel": "chisel",
+	"Glassblower's Bauble":  "bauble",
+	"Orb of Horizons":       "horizon",
+}
+
+// Samples kept per currency, so a flood of listings can't use up unbounded memory
+const maxRateSamples = 10000
+
+// A currency's value in chaos in a league
+type exchangeRate struct {
+	League    string  `json:"league"`
+	Currency  string  `json:"currency"`
+	Chaos     float64 `json:"chaos"`
+	Samples   int     `json:"samples"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+type rateKey struct {
+	League, Currency string
+}
+
+// A chaos value seen on a single listing
+type rateSample struct {
+	itemID string
+	time   time.Time
+	chaos  float64
+}
+
+// exchangeRates works out what each currency is worth in chaos from the currency
+// listings the indexer sees. A currency's rate is the median of its listings over a
+// rolling window, once there are at least minSamples of them. Until then, rates loaded
+// from storage are used, and failing that the defaults. Each listing counts once in the
+// window, however often its stash is sent again, so a seller can't pull the median
+// towards their price by updating their stash. A nil set of rates only knows the
+// defaults.
+//
+// Prices are converted when items are written, so a stored price_chaos is a snapshot
+// at the rates of the time. Items that don't change aren't written again, so they keep
+// their price_chaos as the rates move.
+type exchangeRates struct {
+	window     time.Duration
+	minSamples int
+
+	mu      sync.Mutex
+	samples map[rateKey][]rateSample
+	// The chaos value each listing in the window was sampled at
+	sampled map[rateKey]map[string]float64
+	rates   map[rateKey]exchangeRate
+}
+
+func newExchangeRates(window time.Duration, minSamples int) *exchangeRates {
+	return &exchangeRates{
+		window:     window,
+		minSamples: minSamples,
+		samples:    make(map[rateKey][]rateSample),
+		sampled:    make(map[rateKey]map[string]float64),
+		rates:      make(map[rateKey]exchangeRate),
+	}
+}
+
+// Load uses previously stored rates until enough new listings have been seen
+func (r *exchangeRates) Load(rates []exchangeRate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rate := range rates {
+		r.rates[rateKey{League: rate.League, Currency: rate.Currency}] = rate
+	}
+}
+
+// Observe records the chaos value of every currency item listed for chaos, along with
+// the value of currencies that chaos is listed for. A listing that's already in the
+// window is only sampled again if it's been repriced, replacing its old sample.
+func (r *exchangeRates) Observe(stashes []PlayerStash, now time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	updated := make(map[rateKey]bool)
+	for _, stash := range stashes {
+		for _, item := range stash.FormattedItems {
+			currency := currencyNoteNames[item.TypeLine]
+			if currency == "" || item.PriceCurrency == "" || item.PricePerUnit <= 0 || currency == item.PriceCurrency {
+				continue
+			}
+
+			var key rateKey
+			var chaos float64
+			if item.PriceCurrency == "chaos" {
+				key, chaos = rateKey{League: stash.League, Currency: currency}, float64(item.PricePerUnit)
+			} else if currency == "chaos" {
+				key, chaos = rateKey{League: stash.League, Currency: item.PriceCurrency}, 1/float64(item.PricePerUnit)
+			} else {
+				continue
+			}
+
+			samples := r.samples[key]
+			if prev, ok := r.sampled[key][item.ID]; ok {
+				if prev == chaos {
+					continue
+				}
+				samples = withoutItemSample(samples, item.ID)
+			}
+			if r.sampled[key] == nil {
+				r.sampled[key] = make(map[string]float64)
+			}
+			r.sampled[key][item.ID] = chaos
+
+			samples = append(samples, rateSample{itemID: item.ID, time: now, chaos: chaos})
+			if len(samples) > maxRateSamples {
+				r.forget(key, samples[:len(samples)-maxRateSamples])
+				samples = samples[len(samples)-maxRateSamples:]
+			}
+			r.samples[key] = samples
+			updated[key] = true
+		}
+	}
+
+	// Drop samples that have aged out of the window, then work out the new medians
+	cutoff := now.Add(-r.window)
+	for key, samples := range r.samples {
+		i := sort.Search(len(samples), func(i int) bool { return !samples[i].time.Before(cutoff) })
+		if i == 0 && !updated[key] {
+			continue
+		}
+		r.forget(key, samples[:i])
+		samples = samples[i:]
+		if len(samples) == 0 {
+			delete(r.samples, key)
+			delete(r.sampled, key)
+			continue
+		}
+		r.samples[key] = samples
+
+		if len(samples) >= r.minSamples {
+			r.rates[key] = exchangeRate{
+				League:    key.League,
+				Currency:  key.Currency,
+				Chaos:     medianChaos(samples),
+				Samples:   len(samples),
+				UpdatedAt: now.Format(ESDateFormat),
+			}
+		}
+	}
+}
+
+// forget drops the listings of samples that have left the window, so they're sampled
+// again if they're seen again. Must be called with r.mu held.
+func (r *exchangeRates) forget(key rateKey, samples []rateSample) {
+	for _, sample := range samples {
+		delete(r.sampled[key], sample.itemID)
+	}
+}
+
+// withoutItemSample returns samples without the one taken from an item's listing
+func withoutItemSample(samples []rateSample, itemID string) []rateSample {
+	for i, sample := range samples {
+		if sample.itemID == itemID {
+			return append(samples[:i:i], samples[i+1:]...)
+		}
+	}
+	return samples
+}
+
+// ToChaos converts a price to chaos, returning false if the currency's value isn't known
+func (r *exchangeRates) ToChaos(league, currency string, value float64) (float64, bool) {
+	if currency == "" {
+		return 0, false
+	}
+	if r != nil {
+		r.mu.Lock()
+		rate, ok := r.rates[rateKey{League: league, Currency: currency}]
+		r.mu.Unlock()
+		if ok {
+			return value * rate.Chaos, true
+		}
+	}
+	if chaos, ok := defaultChaosValues[currency]; ok {
+		return value * chaos, true
+	}
+	return 0, false
+}
+
+// Rates returns the current rates for every currency, sorted by league and currency
+func (r *exchangeRates) Rates() []exchangeRate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rates := make([]exchangeRate, 0, len(r.rates))
+	for _, rate := range r.rates {
+		rates = append(rates, rate)
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].League != rates[j].League {
+			return rates[i].League < rates[j].League
+		}
+		return rates[i].Currency < rates[j].Currency
+	})
+	return rates
+}
+
+func medianChaos(samples []rateSample) float64 {
+	values := make([]float64, len(samples))
+	for i, sample := range samples {
+		values[i] = sample.chaos
+	}
+	sort.Float64s(values)
+
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// saveExchangeRatesLoop stores the current rates every interval until ctx is cancelled
+func saveExchangeRatesLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			saveExchangeRates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func saveExchangeRates() {
+	rates := Rates.Rates()
+	if len(rates) == 0 {
+		return
+	}
+	if err := Store.SaveExchangeRates(rates); err != nil {
+		fmt.Printf("Error saving exchange rates: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %d exchange rates\n", len(rates))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func currencyStash(listings ...IndexedItem) []PlayerStash {
+	stash := PlayerStash{ID: "stash1", League: "Sentinel"}
+	for i := range listings {
+		stash.FormattedItems = append(stash.FormattedItems, &listings[i])
+	}
+	return []PlayerStash{stash}
+}
+
+func currencyListing(id, typeLine string, perUnit JSONFloat, currency string) IndexedItem {
+	item := IndexedItem{PricePerUnit: perUnit, PriceCurrency: currency}
+	item.ID = id
+	item.TypeLine = typeLine
+	return item
+}
+
+func TestExchangeRates(t *testing.T) {
+	rates := newExchangeRates(time.Hour, 3)
+	start := time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC)
+
+	// Known currencies fall back to the defaults, others have no value
+	chaos, ok := rates.ToChaos("Sentinel", "exalted", 2)
+	require.True(t, ok)
+	require.Equal(t, 254.0, chaos)
+	_, ok = rates.ToChaos("Sentinel", "divine", 1)
+	require.False(t, ok)
+
+	// Not enough listings yet
+	rates.Observe(currencyStash(
+		currencyListing("item1", "Divine Orb", 200, "chaos"),
+		currencyListing("item2", "Divine Orb", 210, "chaos"),
+	), start)
+	_, ok = rates.ToChaos("Sentinel", "divine", 1)
+	require.False(t, ok)
+
+	// Listings that are sent again don't count twice
+	rates.Observe(currencyStash(
+		currencyListing("item1", "Divine Orb", 200, "chaos"),
+		currencyListing("item2", "Divine Orb", 210, "chaos"),
+	), start)
+	_, ok = rates.ToChaos("Sentinel", "divine", 1)
+	require.False(t, ok)
+
+	// Chaos listed for divines counts towards the divine rate too, and the median
+	// ignores the outlier
+	rates.Observe(currencyStash(
+		currencyListing("item3", "Chaos Orb", 1.0/190, "divine"),
+		currencyListing("item4", "Divine Orb", 1, "chaos"),
+	), start.Add(time.Minute))
+	chaos, ok = rates.ToChaos("Sentinel", "divine", 2)
+	require.True(t, ok)
+	require.InDelta(t, 390.0, chaos, 0.0001)
+	_, ok = rates.ToChaos("Standard", "divine", 1)
+	require.False(t, ok)
+
+	// Once the old listings leave the window, the last rate is kept until there are
+	// enough new ones
+	rates.Observe(currencyStash(currencyListing("item5", "Divine Orb", 150, "chaos")), start.Add(2*time.Hour))
+	chaos, _ = rates.ToChaos("Sentinel", "divine", 1)
+	require.InDelta(t, 195.0, chaos, 0.0001)
+
+	saved := rates.Rates()
+	require.Len(t, saved, 1)
+	require.Equal(t, "divine", saved[0].Currency)
+	require.Equal(t, 4, saved[0].Samples)
+	require.Equal(t, "2022-05-20T00:01:00+0000", saved[0].UpdatedAt)
+
+	loaded := newExchangeRates(time.Hour, 3)
+	loaded.Load(saved)
+	chaos, _ = loaded.ToChaos("Sentinel", "divine", 1)
+	require.InDelta(t, 195.0, chaos, 0.0001)
+
+	// A listing that's been repriced replaces its old sample
+	rates.Observe(currencyStash(
+		currencyListing("item1", "Divine Orb", 160, "chaos"),
+		currencyListing("item2", "Divine Orb", 170, "chaos"),
+	), start.Add(2*time.Hour))
+	rates.Observe(currencyStash(currencyListing("item1", "Divine Orb", 180, "chaos")), start.Add(2*time.Hour))
+	chaos, _ = rates.ToChaos("Sentinel", "divine", 1)
+	require.InDelta(t, 170.0, chaos, 0.0001)
+}
+
+func TestElasticsearchExchangeRatesMissingIndex(t *testing.T) {
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	ESURL = server.URL + "/"
+	store := newElasticsearchStorage(server.Client())
+
+	// Nothing has been saved yet
+	rates, err := store.ExchangeRates()
+	require.NoError(t, err)
+	require.Empty(t, rates)
+
+	// Other errors aren't mistaken for a missing index
+	status = http.StatusInternalServerError
+	_, err = store.ExchangeRates()
+	require.Error(t, err)
+	require.False(t, isNotFound(err))
+}
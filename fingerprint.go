@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fingerprints caches what's stored for recently seen items, set up in main
+var Fingerprints *fingerprintCache
+
+// itemFingerprint summarizes the stored form of an item: its hashes to tell what
+// changed, its price to tell what it was repriced from and when it was listed. It's kept
+// small so the cache can hold plenty of items; an item that changed is read back from
+// storage for the rest of what carries over, like its price history.
+type itemFingerprint struct {
+	ContentHash string
+	PriceHash   string
+	Price       itemPrice
+	CreatedAt   string
+}
+
+// fingerprintItem returns an item's fingerprint from its hashes. Items stored before
+// the hashes existed have none, so they always count as changed.
+func fingerprintItem(item *IndexedItem) itemFingerprint {
+	return itemFingerprint{
+		ContentHash: item.ContentHash,
+		PriceHash:   item.PriceHash,
+		Price:       itemPrice{Value: item.PriceValue, Currency: item.PriceCurrency},
+		CreatedAt:   item.CreatedAt,
+	}
+}
+
+// itemHashes computes the content and price hashes of an item. The content hash covers
+// every indexed field apart from the price and the ones set when the item is written,
+// while the price hash covers every price field, whether it came from the note or the
+// stash tab's name. Both are computed from the item as it came from the stash API, never
+// from a stored copy, so they don't depend on how stored floats round-trip.
+func itemHashes(item *IndexedItem) (content, price string) {
+	c := *item
+	c.ID = ""
+	c.Account = ""
+	c.LastUpdated = ""
+	c.CreatedAt = ""
+	c.ContentHash = ""
+	c.PriceHash = ""
+	c.PriceValue = 0
+	c.PriceCurrency = ""
+	c.PriceChaos = 0
+	c.PriceQuantity = 0
+	c.PricePerUnit = 0
+	c.PriceType = ""
+	c.PriceSource = ""
+	c.PriceError = ""
+	c.Note = ""
+	c.priceHistory = priceHistory{}
+	c.RemovedAt = ""
+	c.TimeToSell = 0
+	b, _ := json.Marshal(c)
+	contentSum := sha256.Sum256(b)
+
+	priceSum := sha256.Sum256([]byte(strings.Join([]string{
+		strconv.FormatFloat(float64(item.PriceValue), 'f', -1, 64),
+		item.PriceCurrency,
+		strconv.FormatFloat(float64(item.PricePerUnit), 'f', -1, 64),
+		strconv.FormatFloat(float64(item.PriceQuantity), 'f', -1, 64),
+		item.PriceType,
+		item.PriceSource,
+		item.PriceError,
+		item.Note,
+	}, "\x00")))
+
+	return hex.EncodeToString(contentSum[:16]), hex.EncodeToString(priceSum[:16])
+}
+
+// fingerprintCache is a bounded LRU map from items to their fingerprints, filled in as
+// items are looked up from or written to storage. A nil cache holds nothing, so every
+// item gets looked up.
+type fingerprintCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[itemRef]*list.Element
+	order   *list.List
+}
+
+// A cache entry, kept in order of use with the most recent at the front
+type fingerprintEntry struct {
+	Ref         itemRef
+	Fingerprint itemFingerprint
+}
+
+func newFingerprintCache(size int) *fingerprintCache {
+	return &fingerprintCache{
+		size:    size,
+		entries: make(map[itemRef]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// Get returns the fingerprint of an item as it was last stored, if it's cached
+func (c *fingerprintCache) Get(ref itemRef) (itemFingerprint, bool) {
+	if c == nil {
+		return itemFingerprint{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[ref]
+	if !ok {
+		return itemFingerprint{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*fingerprintEntry).Fingerprint, true
+}
+
+// Add records an item's fingerprint, evicting the least recently used item if the
+// cache is full
+func (c *fingerprintCache) Add(ref itemRef, fp itemFingerprint) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[ref]; ok {
+		el.Value.(*fingerprintEntry).Fingerprint = fp
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[ref] = c.order.PushFront(&fingerprintEntry{Ref: ref, Fingerprint: fp})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*fingerprintEntry).Ref)
+	}
+}
+
+// Remove drops an item from the cache, so it's looked up from storage next time
+func (c *fingerprintCache) Remove(ref itemRef) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[ref]; ok {
+		c.order.Remove(el)
+		delete(c.entries, ref)
+	}
+}
+
+// Len returns how many items are cached
+func (c *fingerprintCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+// Save writes the cache to a file, so it can be loaded on the next start instead of
+// being warmed up from storage again
+func (c *fingerprintCache) Save(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Oldest first, so loading them in order restores the same recency
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		if err := enc.Encode(el.Value.(*fingerprintEntry)); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Load adds the entries saved in a file to the cache. A missing file leaves the cache
+// empty.
+func (c *fingerprintCache) Load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry fingerprintEntry
+		if err := dec.Decode(&entry); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		c.Add(entry.Ref, entry.Fingerprint)
+	}
+}
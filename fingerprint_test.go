@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintCacheEviction(t *testing.T) {
+	c := newFingerprintCache(2)
+	a, b, d := itemRef{ID: "a", League: "Sentinel"}, itemRef{ID: "b", League: "Sentinel"}, itemRef{ID: "d", League: "Sentinel"}
+
+	c.Add(a, itemFingerprint{ContentHash: "1"})
+	c.Add(b, itemFingerprint{ContentHash: "2"})
+
+	// Using a makes b the least recently used
+	_, ok := c.Get(a)
+	require.True(t, ok)
+	c.Add(d, itemFingerprint{ContentHash: "3"})
+
+	require.Equal(t, 2, c.Len())
+	_, ok = c.Get(b)
+	require.False(t, ok)
+	fp, ok := c.Get(a)
+	require.True(t, ok)
+	require.Equal(t, "1", fp.ContentHash)
+}
+
+func TestFingerprintCacheSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints")
+
+	// Loading a file that doesn't exist yet leaves the cache empty
+	c := newFingerprintCache(10)
+	require.NoError(t, c.Load(path))
+	require.Equal(t, 0, c.Len())
+
+	c.Add(itemRef{ID: "a", League: "Sentinel"}, itemFingerprint{ContentHash: "1", Price: itemPrice{Value: 5, Currency: "chaos"}})
+	c.Add(itemRef{ID: "b", League: "Sentinel"}, itemFingerprint{ContentHash: "2"})
+	require.NoError(t, c.Save(path))
+
+	// A smaller cache keeps the most recently used entries
+	loaded := newFingerprintCache(1)
+	require.NoError(t, loaded.Load(path))
+	require.Equal(t, 1, loaded.Len())
+	_, ok := loaded.Get(itemRef{ID: "a", League: "Sentinel"})
+	require.False(t, ok)
+
+	loaded = newFingerprintCache(10)
+	require.NoError(t, loaded.Load(path))
+	fp, ok := loaded.Get(itemRef{ID: "a", League: "Sentinel"})
+	require.True(t, ok)
+	require.Equal(t, itemPrice{Value: 5, Currency: "chaos"}, fp.Price)
+}
+
+func TestCompareExistingItemsCached(t *testing.T) {
+	Store = newMemoryStorage()
+	Fingerprints = newFingerprintCache(10)
+	defer func() { Fingerprints = nil }()
+
+	// Fingerprints aren't cached until the items have been written
+	stash := testStash(t, "item1", "item2")
+	filtered, fingerprints, err := compareExistingItems([]PlayerStash{stash}, time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, filtered[0].FormattedItems, 2)
+	require.Len(t, fingerprints, 2)
+	require.Equal(t, 0, Fingerprints.Len())
+
+	// An item whose write was dead-lettered stays out of the cache
+	commitFingerprints(fingerprints, nil, []storageOp{{Item: &itemWrite{ID: "item2", League: "Sentinel"}}})
+	require.Equal(t, 1, Fingerprints.Len())
+
+	// Nothing was written to storage, so item1 is only known from the cache and item2
+	// is still new
+	stash = testStash(t, "item1", "item2")
+	filtered, fingerprints, err = compareExistingItems([]PlayerStash{stash}, time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, filtered[0].FormattedItems, 1)
+	require.Equal(t, "item2", filtered[0].FormattedItems[0].ID)
+	require.True(t, filtered[0].FormattedItems[0].create)
+	retry, _, err := persistItems("1-1-2", buildStorageOps(itemUpdate{stashes: filtered}, "2022-05-20T00:00:00+0000"))
+	require.NoError(t, err)
+	require.Empty(t, retry)
+	commitFingerprints(fingerprints, nil, nil)
+
+	// A changed item is read back from storage to carry over its price history
+	stash = testStash(t, "item1", "item2")
+	stash.FormattedItems[1].PriceValue = 10
+	stash.FormattedItems[1].PriceCurrency = "chaos"
+	filtered, _, err = compareExistingItems([]PlayerStash{stash}, time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, filtered[0].FormattedItems, 1)
+	updated := filtered[0].FormattedItems[0]
+	require.Equal(t, "item2", updated.ID)
+	require.False(t, updated.create)
+	require.NotNil(t, updated.prevPrice)
+	require.Equal(t, 1, updated.RepriceCount)
+	require.Len(t, updated.PriceHistory, 2)
+
+	// Removing an item drops it from the cache, unless its removal was dead-lettered
+	removed := itemRef{ID: "item1", League: "Sentinel"}
+	commitFingerprints(nil, []itemRef{removed}, []storageOp{{Removal: &itemRemoval{ID: "item1", League: "Sentinel"}}})
+	_, ok := Fingerprints.Get(removed)
+	require.True(t, ok)
+	commitFingerprints(nil, []itemRef{removed}, nil)
+	_, ok = Fingerprints.Get(removed)
+	require.False(t, ok)
+}
+
+func TestRecordPrice(t *testing.T) {
+	item := &IndexedItem{}
+	item.recordPrice("2022-05-20T00:00:00+0000")
+	require.Nil(t, item.FirstPrice)
+	require.Empty(t, item.PriceHistory)
+
+	item.PriceValue, item.PriceCurrency = 1, "chaos"
+	item.recordPrice("2022-05-20T00:00:00+0000")
+	require.Equal(t, &itemPrice{Value: 1, Currency: "chaos"}, item.FirstPrice)
+	require.Equal(t, 0, item.RepriceCount)
+
+	// Seeing the same price again doesn't count as a reprice
+	item.recordPrice("2022-05-21T00:00:00+0000")
+	require.Equal(t, 0, item.RepriceCount)
+	require.Len(t, item.PriceHistory, 1)
+
+	for i := 2; i <= maxPriceHistory+10; i++ {
+		item.PriceValue = JSONFloat(i)
+		item.recordPrice("2022-05-22T00:00:00+0000")
+	}
+	require.Equal(t, maxPriceHistory+9, item.RepriceCount)
+	require.Equal(t, &itemPrice{Value: 1, Currency: "chaos"}, item.FirstPrice)
+	require.Equal(t, &itemPrice{Value: maxPriceHistory + 10, Currency: "chaos"}, item.LastPrice)
+
+	// Only the latest prices are kept
+	require.Len(t, item.PriceHistory, maxPriceHistory)
+	require.Equal(t, JSONFloat(11), item.PriceHistory[0].Value)
+	require.Equal(t, JSONFloat(maxPriceHistory+10), item.PriceHistory[maxPriceHistory-1].Value)
+}
+
+func TestItemHashes(t *testing.T) {
+	item := testStash(t, "item1").FormattedItems[0]
+	content, price := itemHashes(item)
+
+	// Fields set when the item is written don't count as changes
+	written := *item
+	written.Account = "someone"
+	written.LastUpdated = "2022-05-20T00:00:00+0000"
+	written.ContentHash, written.PriceHash = content, price
+	c, p := itemHashes(&written)
+	require.Equal(t, content, c)
+	require.Equal(t, price, p)
+
+	repriced := *item
+	repriced.PriceValue = 5
+	repriced.PriceCurrency = "chaos"
+	c, p = itemHashes(&repriced)
+	require.Equal(t, content, c)
+	require.NotEqual(t, price, p)
+
+	modded := *item
+	modded.ExplicitMods = append([]Modifier{{Text: "+10 to maximum Life"}}, item.ExplicitMods...)
+	c, p = itemHashes(&modded)
+	require.NotEqual(t, content, c)
+	require.Equal(t, price, p)
+}
+
+func TestItemHashesTabPrice(t *testing.T) {
+	var item Item
+	require.NoError(t, json.Unmarshal([]byte(itemJSON), &item))
+	item.Note = ""
+	priceHash := func(tabName string) string {
+		_, price := itemHashes(item.ToIndexedItem(tabName))
+		return price
+	}
+
+	// The item has no note of its own, so changing the tab's price reprices it
+	require.NotEqual(t, priceHash("~price 3/10 chaos"), priceHash("~price 3/20 chaos"))
+	require.NotEqual(t, priceHash("~b/o 3 chaos"), priceHash("~price 3 chaos"))
+	require.Equal(t, priceHash("~price 3/10 chaos"), priceHash("~price 3/10 chaos"))
+}
+
+// evictingStorage evicts an item's fingerprint whenever items are looked up, like a
+// batch being persisted at the same time
+type evictingStorage struct {
+	*memoryStorage
+	evict itemRef
+}
+
+func (s evictingStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	Fingerprints.Remove(s.evict)
+	return s.memoryStorage.LookupItems(refs)
+}
+
+func TestCompareExistingItemsEvicted(t *testing.T) {
+	Store = evictingStorage{newMemoryStorage(), itemRef{League: "Sentinel", ID: "item1"}}
+	Fingerprints = nil
+	defer func() { Fingerprints = nil }()
+	persistTestStashes(t, []PlayerStash{testStash(t, "item1")})
+	Fingerprints = newFingerprintCache(10)
+	persistTestStashes(t, []PlayerStash{testStash(t, "item1")})
+
+	// item1 is a cached no-op, so it stays one even though it's evicted while item2
+	// is looked up
+	filtered, _, err := compareExistingItems([]PlayerStash{testStash(t, "item1", "item2")}, time.Date(2022, 5, 21, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, filtered[0].FormattedItems, 1)
+	require.Equal(t, "item2", filtered[0].FormattedItems[0].ID)
+}
@@ -2,64 +2,61 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"os"
-	"regexp"
-	"strings"
-	"sync"
 	"time"
 )
 
 const mappingIndex = "stash-mappings"
 const itemIndexPrefix = "items"
 
-const rateLimit = 500 * time.Millisecond
+// How many times to try persisting a chunk before moving it to the dead-letter queue
+const maxPersistAttempts = 5
 
-var priceString = regexp.MustCompile(`\S+\s+(?P<Value>[0-9]*[.|/]?[0-9]+)\s+(?P<Currency>\w+)`)
+// Fetch the next api response. Fetching stops once ctx is cancelled, and outputCh is
+// closed so the later stages can finish the batches they already have.
+func fetchItems(ctx context.Context, client *http.Client, limiter *rateLimiter, tokens *tokenSource, outputCh chan itemUpdate) {
+	defer close(outputCh)
 
-// Fetch the next api response
-func fetchItems(client *http.Client, outputCh chan itemUpdate) {
-	currentID, err := getChangeID(client)
+	currentID, err := Store.ChangeID()
 	if err != nil {
 		panic(err)
 	}
 
-	for {
-		start := time.Now()
-		response, err := getNextStashes(client, currentID)
+	for ctx.Err() == nil {
+		// Requests are paced by the limiter, so there's no need to sleep between them here
+		response, err := getNextStashes(ctx, client, limiter, tokens, currentID)
 		if err != nil {
-			fmt.Printf("Error getting stashes: %v\n", err)
+			if ctx.Err() == nil {
+				fmt.Printf("Error getting stashes: %v\n", err)
+			}
 			continue
 		}
 
-		if len(response.Stashes) == 0 {
+		if len(response.Stashes) == 0 && response.Skipped == 0 {
 			fmt.Println(">>> Reached the end of the stream, waiting for updates...")
 
-			go logCaughtUpToRiver()
-
-			end := time.Now()
-			diff := end.Sub(start)
-			if diff < rateLimit {
-				time.Sleep(rateLimit - diff)
+			if ESURL != "" {
+				go logCaughtUpToRiver()
 			}
 			continue
 		}
 
-		outputCh <- itemUpdate{changeID: response.NextChangeID, stashes: response.Stashes}
-
-		// Sleep so we don't request too frequently (more than once per second)
-		end := time.Now()
-		diff := end.Sub(start)
-		if diff < rateLimit {
-			time.Sleep(rateLimit - diff)
+		if len(response.Stashes) > 0 {
+			// A page that's dropped here was never persisted, so it gets fetched again
+			// on the next start
+			select {
+			case outputCh <- itemUpdate{changeID: response.NextChangeID, time: time.Now(), stashes: response.Stashes}:
+			case <-ctx.Done():
+				return
+			}
 		}
 
 		currentID = response.NextChangeID
 	}
+
+	fmt.Printf("Stopped fetching at change ID %s\n", currentID)
 }
 
 func logCaughtUpToRiver() {
@@ -74,123 +71,231 @@ type itemUpdate struct {
 	changeID        string
 	stashes         []PlayerStash
 	filteredStashes []PlayerStash
-	deletes         []string
+	deletes         []itemRef
+	cleared         []stashRef
+
+	// When the batch was fetched, or recorded if it's being replayed
+	time time.Time
+
+	// When each removed item was listed, where it's known
+	listedAt map[itemRef]string
+
+	// Fingerprints of the created and changed items, only added to the cache once
+	// they've been written
+	fingerprints map[itemRef]itemFingerprint
+}
+
+// An item's ID along with the league it's stored under
+type itemRef struct {
+	ID     string
+	League string
+}
+
+// A stash's ID along with the league it was in
+type stashRef struct {
+	ID     string
+	League string
 }
 
 // Filter out non-league stashes and format the items for storage
-func formatStashLoop(inputCh, outputCh chan itemUpdate) {
-	for {
-		select {
-		case update := <-inputCh:
-			// Filter out non-league items and format for indexing
-			var leagueStashes []PlayerStash
-			stashCount := 0
-			for _, stash := range update.stashes {
-				if stash.League == "Standard" ||
-					stash.League == "Hardcore" ||
-					strings.Contains(stash.League, " ") {
-					continue
-				}
+func formatStashLoop(ctx context.Context, inputCh, outputCh chan itemUpdate) {
+	defer close(outputCh)
+
+	for update := range inputCh {
+		// Filter out non-league items and format for indexing
+		var leagueStashes []PlayerStash
+		stashCount := 0
+		for _, stash := range update.stashes {
+			if !trackedLeague(stash.League) {
+				continue
+			}
 
-				stashCount += 1
-				stash.ItemIDs = make([]string, 0, len(stash.Items))
-				formattedItems := make([]*IndexedItem, 0, len(stash.Items))
-				for _, item := range stash.Items {
-					formattedItems = append(formattedItems, item.ToIndexedItem())
-					stash.ItemIDs = append(stash.ItemIDs, item.ID)
+			// Make sure storage is ready for the league before anything gets
+			// written to it
+			if stash.League != "" {
+				ok := retryWithBackoff(ctx, "setting up storage for league "+stash.League, func() error {
+					return Store.EnsureLeague(stash.League)
+				})
+				if !ok {
+					dropBatches(inputCh)
+					return
 				}
-				stash.FormattedItems = formattedItems
-				stash.Items = nil
-
-				leagueStashes = append(leagueStashes, stash)
 			}
 
-			if len(leagueStashes) == 0 {
-				continue
+			stashCount += 1
+			stash.ItemIDs = make([]string, 0, len(stash.Items))
+			formattedItems := make([]*IndexedItem, 0, len(stash.Items))
+			for _, item := range stash.Items {
+				formattedItems = append(formattedItems, item.ToIndexedItem(stash.Stash))
+				stash.ItemIDs = append(stash.ItemIDs, item.ID)
 			}
+			stash.FormattedItems = formattedItems
+			stash.Items = nil
 
-			update.stashes = leagueStashes
-			outputCh <- update
+			leagueStashes = append(leagueStashes, stash)
 		}
-	}
-}
 
-// Compare incoming items to previously seen state and filter out items that haven't changed
-func lookupItemLoop(inputCh, outputCh chan itemUpdate) {
-	for {
-		select {
-		case update := <-inputCh:
-			checkExisting := true
+		if len(leagueStashes) == 0 {
+			continue
+		}
 
-			if !checkExisting {
-				outputCh <- update
-				continue
-			}
+		Rates.Observe(leagueStashes, update.time)
 
-			filteredStashes := compareExistingItems(update.stashes)
+		update.stashes = leagueStashes
+		outputCh <- update
+	}
+}
 
-			outputCh <- itemUpdate{
-				changeID:        update.changeID,
-				stashes:         update.stashes,
-				filteredStashes: filteredStashes,
-			}
+// Compare incoming items to previously seen state and filter out items that haven't
+// changed. A batch whose lookup fails is retried until it succeeds, since the batches
+// after it can't be persisted first.
+func lookupItemLoop(ctx context.Context, inputCh, outputCh chan itemUpdate) {
+	defer close(outputCh)
+
+	for update := range inputCh {
+		var filteredStashes []PlayerStash
+		var fingerprints map[itemRef]itemFingerprint
+		ok := retryWithBackoff(ctx, "looking up existing items", func() error {
+			var err error
+			filteredStashes, fingerprints, err = compareExistingItems(update.stashes, update.time)
+			return err
+		})
+		if !ok {
+			dropBatches(inputCh)
+			return
 		}
+
+		outputCh <- itemUpdate{
+			changeID:        update.changeID,
+			time:            update.time,
+			stashes:         update.stashes,
+			filteredStashes: filteredStashes,
+			fingerprints:    fingerprints,
+		}
+	}
+}
+
+// dropBatches discards the rest of a stage's input once it's given up on a batch, so
+// the earlier stages can finish. None of their change IDs get saved, so the dropped
+// batches are fetched again on the next start.
+func dropBatches(inputCh chan itemUpdate) {
+	dropped := 0
+	for range inputCh {
+		dropped++
 	}
+	fmt.Printf("Dropped %d unpersisted batches\n", dropped)
 }
 
-func compareExistingItems(stashes []PlayerStash) []PlayerStash {
+// compareExistingItems returns the stashes with only their new and changed items, along
+// with the fingerprints to cache for them once they're written. Items are only changed
+// once every stored item has been looked up, so it can be retried if the lookup fails.
+// New items and prices are dated at batchTime, when the batch was fetched.
+func compareExistingItems(stashes []PlayerStash, batchTime time.Time) ([]PlayerStash, map[itemRef]itemFingerprint, error) {
 	filteredStashes := make([]PlayerStash, 0, len(stashes))
-	createCount, noopCount, updateCount := 0, 0, 0
+	pending := make(map[itemRef]itemFingerprint)
+	createCount, noopCount, updateCount, repriceCount := 0, 0, 0, 0
 
-	// Diff against existing items to detect no-ops
+	// Items that are cached and haven't changed are no-ops. Every other item is fetched
+	// from storage, either to tell whether it changed or to carry over its history. The
+	// cache changes as batches are persisted, so the no-ops are decided once, here.
 	start := time.Now()
-	existingCh := make(chan []IndexedItem)
+	now := batchTime.Format(ESDateFormat)
+	uncached := make([]PlayerStash, 0, len(stashes))
+	cachedNoops := make(map[itemRef]bool)
+	for _, stash := range stashes {
+		var missing []*IndexedItem
+		for _, item := range stash.FormattedItems {
+			item.ContentHash, item.PriceHash = itemHashes(item)
+			ref := itemRef{ID: item.ID, League: stash.League}
+			if prev, ok := Fingerprints.Get(ref); ok && !fingerprintChanged(prev, fingerprintItem(item)) {
+				cachedNoops[ref] = true
+			} else {
+				missing = append(missing, item)
+			}
+		}
+		if len(missing) > 0 {
+			uncached = append(uncached, PlayerStash{League: stash.League, FormattedItems: missing})
+		}
+	}
+
+	// Diff against existing items to detect no-ops
+	existingCh := make(chan existingItems)
 	numWorkers := 8
 	for i := 0; i < numWorkers; i++ {
-		go getExistingItems(stashes[i*len(stashes)/numWorkers:(i+1)*len(stashes)/numWorkers], existingCh)
+		go getExistingItems(uncached[i*len(uncached)/numWorkers:(i+1)*len(uncached)/numWorkers], existingCh)
 	}
 
-	existingMap := make(map[string]IndexedItem, 5000)
+	existingMap := make(map[string]*IndexedItem, 5000)
+	var lookupErr error
 	for i := 0; i < numWorkers; i++ {
-		foundItems := <-existingCh
-		for _, item := range foundItems {
-			existingMap[item.ID] = item
+		existing := <-existingCh
+		if existing.err != nil {
+			lookupErr = existing.err
+			continue
+		}
+		for i := range existing.items {
+			existingMap[existing.items[i].ID] = &existing.items[i]
 		}
 	}
+	if lookupErr != nil {
+		return nil, nil, lookupErr
+	}
 
-	//wrote := false
 	for _, stash := range stashes {
 		var updates []*IndexedItem
 		for _, item := range stash.FormattedItems {
-			prevItem, ok := existingMap[item.ID]
+			ref := itemRef{ID: item.ID, League: stash.League}
+			fp := fingerprintItem(item)
+
+			if cachedNoops[ref] {
+				noopCount++
+				continue
+			}
+
+			stored, ok := existingMap[item.ID]
 			if !ok {
 				item.create = true
+				item.CreatedAt = now
+				item.recordPrice(now)
+				pending[ref] = fingerprintItem(item)
 				createCount++
 				updates = append(updates, item)
 				continue
 			}
 
-			prevItem.Account = item.Account
-			prevItem.LastUpdated = item.LastUpdated
-			prevItem.CreatedAt = item.CreatedAt
-
-			bytesA, _ := json.Marshal(item)
-			bytesB, _ := json.Marshal(prevItem)
-
-			if bytes.Equal(bytesA, bytesB) {
+			// An item that's stored as removed is being listed again, even if it
+			// hasn't changed
+			prev := fingerprintItem(stored)
+			relisted := stored.RemovedAt != ""
+			if !relisted && !fingerprintChanged(prev, fp) {
+				Fingerprints.Add(ref, prev)
 				noopCount++
-			} else {
-				/*if !wrote {
-					if _, err := os.Stat("cmp_prev_item.json"); errors.Is(err, os.ErrNotExist) {
-						os.WriteFile("cmp_new_item.json", bytesA, 0644)
-						os.WriteFile("cmp_prev_item.json", bytesB, 0644)
-					}
-					wrote = true
-				}*/
+				continue
+			}
 
+			contentChanged := prev.ContentHash != fp.ContentHash
+			priceChanged := prev.PriceHash != fp.PriceHash
+			if priceChanged && prev.Price != fp.Price {
+				item.prevPrice = &itemPrice{Value: prev.Price.Value, Currency: prev.Price.Currency}
+			}
+			item.contentChanged = contentChanged
+			if relisted {
+				item.create = true
+				createCount++
+			} else if contentChanged {
 				updateCount++
-				updates = append(updates, item)
+			} else {
+				repriceCount++
 			}
+
+			// The stored document gets replaced, so carry over what's only known from it
+			item.CreatedAt = stored.CreatedAt
+			item.priceHistory = stored.priceHistory
+			item.PriceHistory = append([]pricePoint(nil), stored.PriceHistory...)
+			item.recordPrice(now)
+			pending[ref] = fingerprintItem(item)
+
+			updates = append(updates, item)
 		}
 
 		filteredStashes = append(filteredStashes, PlayerStash{
@@ -206,127 +311,153 @@ func compareExistingItems(stashes []PlayerStash) []PlayerStash {
 		})
 	}
 
-	fmt.Printf("Looked up %v existing stashes in %v\n", len(stashes), time.Since(start))
-	fmt.Printf("%d creates, %d updates, %d no-ops\n", createCount, updateCount, noopCount)
+	fmt.Printf("Looked up %v existing stashes in %v (%d items cached, %d fetched)\n", len(stashes), time.Since(start), len(cachedNoops), len(existingMap))
+	fmt.Printf("%d creates, %d updates, %d reprices, %d no-ops\n", createCount, updateCount, repriceCount, noopCount)
 
-	return filteredStashes
+	return filteredStashes, pending, nil
 }
 
-func getExistingItems(stashes []PlayerStash, existingCh chan []IndexedItem) {
-	// Fetch stash mappings from db
-	body := &bytes.Buffer{}
-	body.WriteString(`{"ids": [`)
-	first := true
-	for _, stash := range stashes {
-		for _, item := range stash.FormattedItems {
-			if !first {
-				body.WriteString(",")
-			} else {
-				first = false
-			}
-			body.WriteString(fmt.Sprintf(`"%s"`, item.ID))
-		}
-	}
-	body.WriteString(`]}`)
-
-	if first {
-		existingCh <- []IndexedItem{}
-		return
-	}
+// fingerprintChanged returns whether an item's content or price differs from what's stored
+func fingerprintChanged(prev, fp itemFingerprint) bool {
+	return prev.ContentHash != fp.ContentHash || prev.PriceHash != fp.PriceHash
+}
 
-	rawBody := string(body.Bytes())
-	var items BulkItemResponse
-	if err := doElasticsearchRequest("GET", itemIndexPrefix+"-archnemesis"+"/_mget", body, &items); err != nil {
-		fmt.Println("Logging request body to existing_items_req.json")
-		os.WriteFile("existing_items_req.json", []byte(rawBody), 0644)
-		existingCh <- []IndexedItem{}
-		return
-	}
+// The stored items found by one of the lookup workers
+type existingItems struct {
+	items []IndexedItem
+	err   error
+}
 
-	foundCount := 0
-	var foundItems []IndexedItem
-	for _, entry := range items.Docs {
-		if entry.Found {
-			foundCount++
-			entry.Source.ID = entry.ID
-			foundItems = append(foundItems, entry.Source)
+func getExistingItems(stashes []PlayerStash, existingCh chan existingItems) {
+	var refs []itemRef
+	for _, stash := range stashes {
+		for _, item := range stash.FormattedItems {
+			refs = append(refs, itemRef{ID: item.ID, League: stash.League})
 		}
 	}
 
-	existingCh <- foundItems
+	foundItems, err := Store.LookupItems(refs)
+	existingCh <- existingItems{items: foundItems, err: err}
 }
 
-// Compare stash contents against previously seen state to detect item removals
-func diffStashLoop(client *http.Client, inputCh, outputCh chan itemUpdate) {
-	for {
-		select {
-		case update := <-inputCh:
-			// Find removed items by comparing to previous stash contents
-			deletes, err := diffStashes(client, update.stashes)
+// Compare stash contents against previously seen state to detect item removals. Like
+// lookups, a batch whose diff fails is retried until it succeeds.
+func diffStashLoop(ctx context.Context, inputCh, outputCh chan itemUpdate) {
+	defer close(outputCh)
+
+	for update := range inputCh {
+		// Find removed items by comparing to previous stash contents
+		var deletes []itemRef
+		var cleared []stashRef
+		var listedAt map[itemRef]string
+		ok := retryWithBackoff(ctx, "diffing stashes", func() error {
+			var err error
+			deletes, cleared, err = diffStashes(update.stashes)
 			if err != nil {
-				fmt.Printf("Error diffing stashes: %v\n", err)
-				continue
+				return err
 			}
-			//fmt.Printf("%d deletes\n", len(deletes))
+			listedAt, err = lookupListedTimes(deletes)
+			return err
+		})
+		if !ok {
+			dropBatches(inputCh)
+			return
+		}
 
-			newStashes := update.filteredStashes
-			if newStashes == nil {
-				newStashes = update.stashes
-			}
+		newStashes := update.filteredStashes
+		if newStashes == nil {
+			newStashes = update.stashes
+		}
 
-			outputCh <- itemUpdate{
-				changeID: update.changeID,
-				stashes:  newStashes,
-				deletes:  deletes,
-			}
+		outputCh <- itemUpdate{
+			changeID:     update.changeID,
+			time:         update.time,
+			stashes:      newStashes,
+			deletes:      deletes,
+			cleared:      cleared,
+			listedAt:     listedAt,
+			fingerprints: update.fingerprints,
 		}
 	}
 }
 
-func diffStashes(client *http.Client, stashes []PlayerStash) ([]string, error) {
-	start := time.Now()
-
-	// Fetch stash mappings from db
-	body := &bytes.Buffer{}
-	body.WriteString(`{"ids": [`)
-	for i, stash := range stashes {
-		if i > 0 {
-			body.WriteString(",")
+// lookupListedTimes returns when removed items were first listed, from the fingerprint
+// cache or else storage, so their removals can record how long they took to sell
+func lookupListedTimes(deletes []itemRef) (map[itemRef]string, error) {
+	listedAt := make(map[itemRef]string, len(deletes))
+	var uncached []itemRef
+	for _, ref := range deletes {
+		if fp, ok := Fingerprints.Get(ref); ok {
+			listedAt[ref] = fp.CreatedAt
+		} else {
+			uncached = append(uncached, ref)
 		}
-		body.WriteString(fmt.Sprintf(`"%s"`, stash.ID))
 	}
-	body.WriteString(`]}`)
+	if len(uncached) == 0 {
+		return listedAt, nil
+	}
 
-	rawBody := string(body.Bytes())
-	var mappings StashMappingResponse
-	if err := doElasticsearchRequest("GET", mappingIndex+"/_mget", body, &mappings); err != nil {
-		fmt.Println("Logging request body to diff_req.json")
-		os.WriteFile("diff_req.json", []byte(rawBody), 0644)
+	found, err := Store.LookupItems(uncached)
+	if err != nil {
 		return nil, err
 	}
+	leagues := make(map[string]string, len(uncached))
+	for _, ref := range uncached {
+		leagues[ref.ID] = ref.League
+	}
+	for _, item := range found {
+		listedAt[itemRef{ID: item.ID, League: leagues[item.ID]}] = item.CreatedAt
+	}
+	return listedAt, nil
+}
 
-	oldStashes := make(map[string]map[string]bool, len(mappings.Docs))
-	found := 0
-	for _, doc := range mappings.Docs {
-		if doc.Found {
-			found += 1
-		} else {
-			continue
-		}
+// diffStashes returns the items that are no longer in their stashes, along with the
+// stashes that had items before and are now empty
+func diffStashes(stashes []PlayerStash) ([]itemRef, []stashRef, error) {
+	start := time.Now()
+
+	// Fetch stash mappings from db
+	stashIDs := make([]string, 0, len(stashes))
+	for _, stash := range stashes {
+		stashIDs = append(stashIDs, stash.ID)
+	}
+	mappings, err := Store.LookupStashMappings(stashIDs)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		oldStashes[doc.ID] = make(map[string]bool, len(doc.Source.ItemIDs))
-		for _, itemID := range doc.Source.ItemIDs {
-			oldStashes[doc.ID][itemID] = true
+	oldStashes := make(map[string]map[string]bool, len(mappings))
+	oldLeagues := make(map[string]string, len(mappings))
+	for stashID, mapping := range mappings {
+		oldLeagues[stashID] = mapping.League
+
+		oldStashes[stashID] = make(map[string]bool, len(mapping.ItemIDs))
+		for _, itemID := range mapping.ItemIDs {
+			oldStashes[stashID][itemID] = true
 		}
 	}
-	fmt.Printf("Found %d existing stashes to compare\n", found)
+	fmt.Printf("Found %d existing stashes to compare\n", len(mappings))
 
 	// Compare to new stash mappings
 	currentStashes := make(map[string]map[string]bool, 256)
+	var cleared []stashRef
 	for _, stash := range stashes {
 		if _, ok := oldStashes[stash.ID]; !ok {
 			continue
 		}
+		if len(oldStashes[stash.ID]) > 0 && len(stash.FormattedItems) == 0 {
+			league := oldLeagues[stash.ID]
+			if league == "" {
+				league = stash.League
+			}
+			cleared = append(cleared, stashRef{ID: stash.ID, League: league})
+		}
+
+		// Mappings written before leagues were recorded fall back to the stash's
+		// current league, if it still has one
+		if oldLeagues[stash.ID] == "" {
+			oldLeagues[stash.ID] = stash.League
+		}
 
 		currentStashes[stash.ID] = make(map[string]bool, len(stash.FormattedItems))
 		for _, item := range stash.FormattedItems {
@@ -334,153 +465,109 @@ func diffStashes(client *http.Client, stashes []PlayerStash) ([]string, error) {
 		}
 	}
 
-	var deletes []string
+	var deletes []itemRef
+	unknownLeague := 0
 	for stashID, stash := range oldStashes {
 		for itemID := range stash {
 			if _, ok := currentStashes[stashID][itemID]; !ok {
-				deletes = append(deletes, itemID)
+				if oldLeagues[stashID] == "" {
+					unknownLeague++
+					continue
+				}
+				deletes = append(deletes, itemRef{ID: itemID, League: oldLeagues[stashID]})
 			}
 		}
 	}
 
 	delta := time.Since(start)
 	fmt.Printf("Diffed %v stashes in %v\n", len(stashes), delta)
+	if unknownLeague > 0 {
+		fmt.Printf("Skipped %d removed items with no known league\n", unknownLeague)
+	}
 
-	return deletes, nil
+	return deletes, cleared, nil
 }
 
-// Persist item creates, updates and deletes to the database
-func persistItemLoop(inputCh chan itemUpdate, outputCh chan string) {
-	for {
-		select {
-		case update := <-inputCh:
-			start := time.Now()
-			itemCount := 0
-			for _, stash := range update.stashes {
-				itemCount += len(stash.FormattedItems)
-			}
-
-			var wg sync.WaitGroup
-			numWorkers := 8
-			for i := 0; i < numWorkers; i++ {
-				updateChunk := itemUpdate{
-					stashes: update.stashes[i*len(update.stashes)/numWorkers : (i+1)*len(update.stashes)/numWorkers],
-					deletes: update.deletes[i*len(update.deletes)/numWorkers : (i+1)*len(update.deletes)/numWorkers],
-				}
+// Persist item creates, updates and deletes to the database, dated when their batch was
+// fetched so replayed batches keep their original times. The change ID is only
+// passed on once every chunk of the update has been written (or dead-lettered after
+// repeated failures) and the sinks have it, so a restart never skips data that didn't
+// make it into storage or the sinks. Once ctx is cancelled, failed writes are
+// dead-lettered right away instead of backing off.
+func persistItemLoop(ctx context.Context, inputCh chan itemUpdate, outputCh chan string) {
+	defer close(outputCh)
 
-				wg.Add(1)
-				go persistItems(updateChunk, &wg)
-			}
-			wg.Wait()
-
-			delta := time.Since(start)
-			fmt.Printf("Persisted [%d S | %d I | %d R] in %s\n", len(update.stashes), itemCount, len(update.deletes), delta)
-			outputCh <- update.changeID
+	for update := range inputCh {
+		start := time.Now()
+		date := update.time.Format(ESDateFormat)
+		itemCount := 0
+		for _, stash := range update.stashes {
+			itemCount += len(stash.FormattedItems)
 		}
-	}
-}
 
-func persistItems(update itemUpdate, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	body := &bytes.Buffer{}
-	itemCount := 0
-	stashCount := 0
-
-	start := time.Now()
-	date := start.Format(ESDateFormat)
-
-	if len(update.stashes) == 0 {
-		return
-	}
-
-	leagueIndex := itemIndexPrefix + "-archnemesis"
-	for _, itemID := range update.deletes {
-		body.WriteString(fmt.Sprintf(`{"update":{"_index":"%s","_id":"%s"}}`+"\n", leagueIndex, itemID))
-		body.WriteString(fmt.Sprintf(`{"doc":{"removed_at":"%s"}}`+"\n", date))
-	}
-
-	for _, stash := range update.stashes {
-		stashCount += 1
-
-		index := strings.ToLower(fmt.Sprintf("%s-%v", itemIndexPrefix, stash.League))
-		for _, item := range stash.FormattedItems {
-			item.Account = stash.AccountName
-			item.LastUpdated = date
-			if item.create {
-				item.CreatedAt = date
-			}
-
-			// Blank out item.ID so it doesn't get indexed
-			id := item.ID
-			item.ID = ""
-
-			json, _ := json.Marshal(item)
-			body.WriteString(fmt.Sprintf(`{"index":{"_index":"%s","_id":"%s"}}`+"\n", index, id))
-			body.Write(json)
-			body.WriteString("\n")
+		deadLettered := persistBatch(ctx, update.changeID, chunkStorageOps(update, date))
+		commitFingerprints(update.fingerprints, update.deletes, deadLettered)
+		batch := withoutDeadLetters(persistedBatch{
+			ChangeID: update.changeID,
+			Time:     update.time,
+			Stashes:  update.stashes,
+			Deletes:  update.deletes,
+			Cleared:  update.cleared,
+		}, deadLettered)
+		if !writeToSinks(ctx, batch) {
+			// Leave the change ID where it was, so the batch is fetched again and
+			// reaches the sinks after a restart
+			dropBatches(inputCh)
+			return
 		}
 
-		body.WriteString(fmt.Sprintf(`{"index":{"_index": "%s", "_id":"%s"}}`+"\n", mappingIndex, stash.ID))
-		stashBytes, _ := json.Marshal(StashMapping{
-			LastUpdated: date,
-			ItemIDs:     stash.ItemIDs,
-		})
-		body.Write(stashBytes)
-		body.WriteString("\n")
-
-		itemCount += len(stash.FormattedItems)
-	}
-
-	rawBody := string(body.Bytes())
-	compressed := &bytes.Buffer{}
-	gz := gzip.NewWriter(compressed)
-	if _, err := gz.Write(body.Bytes()); err != nil {
-		panic(err)
-	}
-	if err := gz.Close(); err != nil {
-		panic(err)
-	}
-
-	req, err := http.NewRequest("POST", ESURL+"_bulk?_source=false", compressed)
-	if err != nil {
-		fmt.Printf("Error in request persisting items: %v\n", err)
-		return
+		delta := time.Since(start)
+		fmt.Printf("Persisted [%d S | %d I | %d R] in %s\n", len(update.stashes), itemCount, len(update.deletes), delta)
+		outputCh <- update.changeID
 	}
+}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+// commitFingerprints caches the fingerprints of a persisted batch's items and drops the
+// ones of its removed items, so they're looked up again if they're relisted. Items whose
+// writes were dead-lettered are left as they were, so they're still seen as changed
+// next time. Removals are dropped first, since an item that moved stashes in the batch
+// is both removed and written.
+func commitFingerprints(fingerprints map[itemRef]itemFingerprint, deletes []itemRef, deadLettered []storageOp) {
+	failed := make(map[itemRef]bool)
+	failedRemovals := make(map[itemRef]bool)
+	for _, op := range deadLettered {
+		switch op.kind() {
+		case opItem:
+			failed[itemRef{ID: op.Item.ID, League: op.Item.League}] = true
+		case opRemoval:
+			failedRemovals[itemRef{ID: op.Removal.ID, League: op.Removal.League}] = true
+		}
 	}
-	setBasicAuth(req)
-	req.Header.Set("Content-Type", "application/x-ndjson")
-	req.Header.Set("Content-Encoding", "gzip")
-	resp, err := client.Do(req)
-	if err != nil {
-		resp.Body.Close()
-		fmt.Printf("Error in response persisting items: %v\n", err)
-		return
+	for _, ref := range deletes {
+		if !failedRemovals[ref] {
+			Fingerprints.Remove(ref)
+		}
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		fmt.Printf("Error: status code %d\n", resp.StatusCode)
-		fmt.Printf("Headers: %v\n", resp.Header)
-		body, _ := ioutil.ReadAll(resp.Body)
-		fmt.Println("Response Body:", string(body))
-		fmt.Println("Logging request body to index_req.json")
-		os.WriteFile("index_req.json", []byte(rawBody), 0644)
-		return
+	for ref, fp := range fingerprints {
+		if !failed[ref] {
+			Fingerprints.Add(ref, fp)
+		}
 	}
 }
 
-func updateChangeIDLoop(client *http.Client, inputCh chan string) {
-	for {
-		select {
-		case changeID := <-inputCh:
-			// Update stored change ID
-			if err := persistChangeID(client, changeID); err != nil {
-				fmt.Printf("Error persisting change ID: %v\n", err)
-			}
+// Store each change ID as its batch is persisted, returning once inputCh is closed
+func updateChangeIDLoop(inputCh chan string) {
+	lastID := ""
+	for changeID := range inputCh {
+		// Update stored change ID
+		if err := Store.SaveChangeID(changeID); err != nil {
+			fmt.Printf("Error persisting change ID: %v\n", err)
+			continue
 		}
+		lastID = changeID
+	}
+
+	if lastID != "" {
+		fmt.Printf("Persisted final change ID %s\n", lastID)
 	}
 }
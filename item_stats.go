@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Damage and defence stats worked out from an item's properties, so listings can be
+// sorted by them. The Q20 variants are what the stat would be at 20% quality, for items
+// that have less.
+type itemStats struct {
+	DPS     JSONDouble `json:"dps,omitempty"`
+	PDPS    JSONDouble `json:"pdps,omitempty"`
+	EDPS    JSONDouble `json:"edps,omitempty"`
+	CDPS    JSONDouble `json:"cdps,omitempty"`
+	DPSQ20  JSONDouble `json:"dps_q20,omitempty"`
+	PDPSQ20 JSONDouble `json:"pdps_q20,omitempty"`
+
+	Armour          JSONDouble `json:"armour,omitempty"`
+	Evasion         JSONDouble `json:"evasion,omitempty"`
+	EnergyShield    JSONDouble `json:"energy_shield,omitempty"`
+	Ward            JSONDouble `json:"ward,omitempty"`
+	ArmourQ20       JSONDouble `json:"armour_q20,omitempty"`
+	EvasionQ20      JSONDouble `json:"evasion_q20,omitempty"`
+	EnergyShieldQ20 JSONDouble `json:"energy_shield_q20,omitempty"`
+	WardQ20         JSONDouble `json:"ward_q20,omitempty"`
+}
+
+// Local mods that increase a stat that quality also increases, keyed by the mod's text
+var localIncreaseMods = map[string][]string{
+	"#% increased Physical Damage":                   {"Physical Damage"},
+	"#% increased Armour":                            {"Armour"},
+	"#% increased Evasion Rating":                    {"Evasion Rating"},
+	"#% increased Energy Shield":                     {"Energy Shield"},
+	"#% increased Ward":                              {"Ward"},
+	"#% increased Armour and Evasion":                {"Armour", "Evasion Rating"},
+	"#% increased Armour and Energy Shield":          {"Armour", "Energy Shield"},
+	"#% increased Evasion and Energy Shield":         {"Evasion Rating", "Energy Shield"},
+	"#% increased Armour, Evasion and Energy Shield": {"Armour", "Evasion Rating", "Energy Shield"},
+}
+
+// computeItemStats works out an item's stats from its properties, which show the values
+// with quality and local mods already applied. out needs its mods formatted, to find
+// how much local mods add on top of quality.
+func computeItemStats(props Properties, out *IndexedItem) itemStats {
+	values := make(map[string][][1]string, len(props))
+	for _, prop := range props {
+		values[prop.Name] = prop.Values
+	}
+
+	increased := make(map[string]float64)
+	for _, mods := range [][]Modifier{out.ImplicitMods, out.FracturedMods, out.ExplicitMods, out.CraftedMods} {
+		for _, mod := range mods {
+			if len(mod.Values) != 1 {
+				continue
+			}
+			for _, stat := range localIncreaseMods[mod.Text] {
+				increased[stat] += float64(mod.Values[0])
+			}
+		}
+	}
+
+	quality := 0.0
+	if q := values["Quality"]; len(q) > 0 {
+		quality, _ = strconv.ParseFloat(strings.Trim(q[0][0], "+% "), 64)
+	}
+	atQ20 := func(stat string, value float64) float64 {
+		if quality >= 20 {
+			return value
+		}
+		inc := increased[stat]
+		return value * (100 + inc + 20) / (100 + inc + quality)
+	}
+
+	var stats itemStats
+	if aps := propertyAverage(values["Attacks per Second"]); aps > 0 {
+		pdps := propertyAverage(values["Physical Damage"]) * aps
+		edps := propertyTotal(values["Elemental Damage"]) * aps
+		cdps := propertyAverage(values["Chaos Damage"]) * aps
+		pdpsQ20 := atQ20("Physical Damage", pdps)
+
+		stats.PDPS = JSONDouble(pdps)
+		stats.EDPS = JSONDouble(edps)
+		stats.CDPS = JSONDouble(cdps)
+		stats.DPS = JSONDouble(pdps + edps + cdps)
+		stats.PDPSQ20 = JSONDouble(pdpsQ20)
+		stats.DPSQ20 = JSONDouble(pdpsQ20 + edps + cdps)
+	}
+
+	for _, defence := range []struct {
+		name       string
+		value, q20 *JSONDouble
+	}{
+		{"Armour", &stats.Armour, &stats.ArmourQ20},
+		{"Evasion Rating", &stats.Evasion, &stats.EvasionQ20},
+		{"Energy Shield", &stats.EnergyShield, &stats.EnergyShieldQ20},
+		{"Ward", &stats.Ward, &stats.WardQ20},
+	} {
+		if value := propertyAverage(values[defence.name]); value > 0 {
+			*defence.value = JSONDouble(value)
+			*defence.q20 = JSONDouble(atQ20(defence.name, value))
+		}
+	}
+
+	return stats
+}
+
+// propertyAverage returns the first value of a property, or the middle of it if it's a
+// range like "62-130"
+func propertyAverage(values [][1]string) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	return rangeAverage(values[0][0])
+}
+
+// propertyTotal adds up the averages of all of a property's values, e.g. each type of
+// elemental damage
+func propertyTotal(values [][1]string) float64 {
+	total := 0.0
+	for _, value := range values {
+		total += rangeAverage(value[0])
+	}
+	return total
+}
+
+func rangeAverage(value string) float64 {
+	parts := strings.SplitN(value, "-", 2)
+	total := 0.0
+	for _, part := range parts {
+		v, _ := strconv.ParseFloat(strings.Trim(part, "+% "), 64)
+		total += v
+	}
+	return total / float64(len(parts))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeItemStats(t *testing.T) {
+	item := Item{}
+	item.Properties = Properties{
+		{Name: "Quality", Values: [][1]string{{"+10%"}}},
+		{Name: "Physical Damage", Values: [][1]string{{"100-200"}}},
+		{Name: "Chaos Damage", Values: [][1]string{{"10-30"}}},
+		{Name: "Attacks per Second", Values: [][1]string{{"1.50"}}},
+	}
+	item.ExplicitMods = []string{"150% increased Physical Damage"}
+
+	stats := item.ToIndexedItem("").itemStats
+	require.Equal(t, JSONDouble(225), stats.PDPS)
+	require.Equal(t, JSONDouble(30), stats.CDPS)
+	require.Equal(t, JSONDouble(255), stats.DPS)
+	// 225 at 260% increased becomes 225 * 270 / 260 at 20% quality
+	require.InDelta(t, 233.65, float64(stats.PDPSQ20), 0.01)
+	require.InDelta(t, 263.65, float64(stats.DPSQ20), 0.01)
+	require.Zero(t, stats.Armour)
+
+	// Hybrid local mods count towards each of their defences
+	item = Item{}
+	item.Properties = Properties{
+		{Name: "Quality", Values: [][1]string{{"+5%"}}},
+		{Name: "Armour", Values: [][1]string{{"630"}}},
+		{Name: "Energy Shield", Values: [][1]string{{"105"}}},
+	}
+	item.ExplicitMods = []string{"100% increased Armour and Energy Shield", "20% increased Armour"}
+
+	stats = item.ToIndexedItem("").itemStats
+	require.Equal(t, JSONDouble(630), stats.Armour)
+	require.Equal(t, JSONDouble(105), stats.EnergyShield)
+	require.InDelta(t, 630.0*240/225, float64(stats.ArmourQ20), 0.01)
+	require.InDelta(t, 105.0*220/205, float64(stats.EnergyShieldQ20), 0.01)
+	require.Zero(t, stats.DPS)
+
+	// Items at 20% quality or more are already at their Q20 values
+	item.Properties[0].Values = [][1]string{{"+23%"}}
+	stats = item.ToIndexedItem("").itemStats
+	require.Equal(t, stats.Armour, stats.ArmourQ20)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// messageWriter is the part of kafka.Writer the publisher uses, so tests can swap in a fake
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaPublisher publishes the lifecycle events for each persisted batch to a Kafka
+// topic. Events are keyed by item ID, or stash ID for stash events, so all events for
+// an item land on the same partition in order. The change ID and event type are
+// carried in headers so consumers can filter without decoding the value.
+type kafkaPublisher struct {
+	writer  messageWriter
+	timeout time.Duration
+}
+
+func newKafkaPublisher(brokers []string, topic string) *kafkaPublisher {
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireAll,
+			BatchSize:              1000,
+			BatchTimeout:           50 * time.Millisecond,
+			AllowAutoTopicCreation: true,
+		},
+		timeout: 30 * time.Second,
+	}
+}
+
+// parseKafkaBrokers splits a comma-separated list of broker addresses
+func parseKafkaBrokers(brokers string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(brokers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (p *kafkaPublisher) WriteBatch(batch persistedBatch) error {
+	events := buildItemEvents(batch)
+	if len(events) == 0 {
+		return nil
+	}
+
+	msgs := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		key := event.ItemID
+		if key == "" {
+			key = event.StashID
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:   []byte(key),
+			Value: value,
+			Time:  event.Time,
+			Headers: []kafka.Header{
+				{Key: "change_id", Value: []byte(event.ChangeID)},
+				{Key: "event_type", Value: []byte(event.Type)},
+			},
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	return p.writer.WriteMessages(ctx, msgs...)
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
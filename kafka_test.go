@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMessageWriter stands in for a Kafka broker, keeping every message it's given
+type fakeMessageWriter struct {
+	msgs []kafka.Message
+}
+
+func (w *fakeMessageWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeMessageWriter) Close() error {
+	return nil
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	writer := &fakeMessageWriter{}
+	publisher := &kafkaPublisher{writer: writer, timeout: time.Second}
+
+	stash := testStash(t, "item1")
+	stash.FormattedItems[0].create = true
+	require.NoError(t, publisher.WriteBatch(persistedBatch{
+		ChangeID: "1-1-1",
+		Time:     time.Now(),
+		Stashes:  []PlayerStash{stash},
+		Deletes:  []itemRef{{ID: "item2", League: "Sentinel"}},
+		Cleared:  []stashRef{{ID: "stash2", League: "Sentinel"}},
+	}))
+
+	require.Len(t, writer.msgs, 3)
+	var keys []string
+	for _, msg := range writer.msgs {
+		keys = append(keys, string(msg.Key))
+		require.Equal(t, []kafka.Header{
+			{Key: "change_id", Value: []byte("1-1-1")},
+			{Key: "event_type", Value: msg.Headers[1].Value},
+		}, msg.Headers)
+	}
+	require.Equal(t, []string{"item2", "item1", "stash2"}, keys)
+
+	var event itemEvent
+	require.NoError(t, json.Unmarshal(writer.msgs[1].Value, &event))
+	require.Equal(t, eventItemListed, event.Type)
+	require.Equal(t, eventItemListed, string(writer.msgs[1].Headers[1].Value))
+	require.Equal(t, "stash1", event.StashID)
+	require.Equal(t, "Rapture Nock", event.Item.Name)
+
+	require.Equal(t, []string{"a:9092", "b:9092"}, parseKafkaBrokers(" a:9092, b:9092,"))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leagues that never end, which auto-detection skips in favor of the current
+// challenge leagues
+var permanentLeagues = map[string]bool{
+	"Standard":              true,
+	"Hardcore":              true,
+	"SSF Standard":          true,
+	"SSF Hardcore":          true,
+	"Ruthless":              true,
+	"Hardcore Ruthless":     true,
+	"SSF Ruthless":          true,
+	"SSF Hardcore Ruthless": true,
+}
+
+// TrackedLeagues is the league selection used by the indexer, set from the environment in main
+var TrackedLeagues = &leagueConfig{auto: true}
+
+// leagueConfig selects which leagues get indexed. An explicit allow-list takes
+// precedence over auto-detection, and the deny-list applies to both. Auto-detection
+// uses the league registry once it has loaded, and falls back to guessing from the
+// league name otherwise.
+type leagueConfig struct {
+	allow    map[string]bool
+	deny     map[string]bool
+	auto     bool
+	registry *leagueRegistry
+}
+
+// parseLeagueConfig builds a league selection from a comma-separated allow-list
+// (or "auto" to detect the current challenge leagues) and a comma-separated deny-list
+func parseLeagueConfig(allow, deny string) *leagueConfig {
+	config := &leagueConfig{
+		allow: make(map[string]bool),
+		deny:  make(map[string]bool),
+	}
+
+	allow = strings.TrimSpace(allow)
+	if allow == "" || strings.EqualFold(allow, "auto") {
+		config.auto = true
+	} else {
+		for _, league := range strings.Split(allow, ",") {
+			if league = strings.TrimSpace(league); league != "" {
+				config.allow[league] = true
+			}
+		}
+	}
+
+	for _, league := range strings.Split(deny, ",") {
+		if league = strings.TrimSpace(league); league != "" {
+			config.deny[league] = true
+		}
+	}
+
+	return config
+}
+
+func leagueConfigFromEnv() *leagueConfig {
+	return parseLeagueConfig(os.Getenv("LEAGUES"), os.Getenv("LEAGUES_EXCLUDE"))
+}
+
+// Tracked reports whether stashes from the given league should be indexed
+func (c *leagueConfig) Tracked(league string) bool {
+	// Stashes that were emptied or made private come through without a league, and
+	// still need to be diffed so their items get marked as removed
+	if league == "" {
+		return true
+	}
+	if !c.allowed(league) {
+		return false
+	}
+	if c.auto && c.registry != nil && c.registry.Loaded() {
+		return c.registry.Active(league)
+	}
+	return true
+}
+
+// allowed applies the allow and deny lists, without checking whether the league is active
+func (c *leagueConfig) allowed(league string) bool {
+	if c.deny[league] {
+		return false
+	}
+	if !c.auto {
+		return c.allow[league]
+	}
+
+	// Private leagues are named like "My League (PL12345)"
+	return !permanentLeagues[league] && !strings.Contains(league, "(PL")
+}
+
+// Configured returns the leagues named in the allow-list
+func (c *leagueConfig) Configured() []string {
+	var leagues []string
+	for league := range c.allow {
+		leagues = append(leagues, league)
+	}
+	return leagues
+}
+
+func (c *leagueConfig) String() string {
+	var parts []string
+	if c.auto {
+		parts = append(parts, "auto")
+	} else {
+		parts = append(parts, fmt.Sprintf("allow=%v", c.Configured()))
+	}
+	if len(c.deny) > 0 {
+		var denied []string
+		for league := range c.deny {
+			denied = append(denied, league)
+		}
+		parts = append(parts, fmt.Sprintf("deny=%v", denied))
+	}
+	return strings.Join(parts, " ")
+}
+
+// trackedLeague reports whether stashes from the given league should be indexed
+func trackedLeague(league string) bool {
+	return TrackedLeagues.Tracked(league)
+}
+
+// itemIndexName returns the index holding items for a league, e.g. "items-hardcore-sentinel"
+func itemIndexName(league string) string {
+	var b strings.Builder
+	b.WriteString(itemIndexPrefix + "-")
+	for _, r := range strings.ToLower(league) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+const defaultLeaguesURL = "https://api.pathofexile.com/leagues?type=main&realm=pc"
+
+// leagueInfo is a league as described by the PoE leagues API
+type leagueInfo struct {
+	ID      string     `json:"id"`
+	Realm   string     `json:"realm,omitempty"`
+	StartAt *time.Time `json:"startAt"`
+	EndAt   *time.Time `json:"endAt"`
+}
+
+// activeAt reports whether the league has started and not yet ended at time t
+func (l leagueInfo) activeAt(t time.Time) bool {
+	if l.StartAt != nil && l.StartAt.After(t) {
+		return false
+	}
+	return l.EndAt == nil || l.EndAt.After(t)
+}
+
+// leagueRegistry tracks which leagues are currently active, periodically reloading
+// them from the leagues API or a local JSON file in the same format.
+type leagueRegistry struct {
+	load        func() ([]leagueInfo, error)
+	onNewLeague func(league string) error
+
+	mu     sync.RWMutex
+	active map[string]bool
+}
+
+func newLeagueRegistry(load func() ([]leagueInfo, error), onNewLeague func(league string) error) *leagueRegistry {
+	return &leagueRegistry{
+		load:        load,
+		onNewLeague: onNewLeague,
+	}
+}
+
+// Loaded reports whether the registry has successfully loaded the leagues at least once
+func (r *leagueRegistry) Loaded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.active != nil
+}
+
+// Active reports whether the league was active as of the last refresh
+func (r *leagueRegistry) Active(league string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.active[league]
+}
+
+// Refresh reloads the leagues and calls onNewLeague for any league that has become active
+func (r *leagueRegistry) Refresh() error {
+	leagues, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	active := make(map[string]bool, len(leagues))
+	for _, league := range leagues {
+		if league.activeAt(now) {
+			active[league.ID] = true
+		}
+	}
+
+	// Set up new leagues before they're marked active, so nothing gets indexed
+	// into a league without its index
+	for league := range active {
+		if r.Active(league) || r.onNewLeague == nil {
+			continue
+		}
+		if err := r.onNewLeague(league); err != nil {
+			return err
+		}
+		fmt.Printf("Discovered new league: %s\n", league)
+	}
+
+	r.mu.Lock()
+	r.active = active
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Reload the leagues on an interval so new leagues are picked up without a restart
+func leagueRefreshLoop(registry *leagueRegistry, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := registry.Refresh(); err != nil {
+			fmt.Printf("Error refreshing leagues: %v\n", err)
+		}
+	}
+}
+
+// loadLeaguesFromURL fetches the current leagues from the PoE leagues API
+func loadLeaguesFromURL(client *http.Client, url string) func() ([]leagueInfo, error) {
+	return func() ([]leagueInfo, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", UserAgent)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			log.Printf("Error: status code %d", resp.StatusCode)
+			log.Println("Response Body:", string(body))
+			return nil, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+		}
+
+		return parseLeagues(body)
+	}
+}
+
+// loadLeaguesFromFile reads leagues from a local file, as a stand-in for the API
+func loadLeaguesFromFile(path string) func() ([]leagueInfo, error) {
+	return func() ([]leagueInfo, error) {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return parseLeagues(body)
+	}
+}
+
+// parseLeagues accepts both the legacy API's bare list of leagues and the OAuth
+// API's {"leagues": [...]} wrapper
+func parseLeagues(body []byte) ([]leagueInfo, error) {
+	var leagues []leagueInfo
+	if err := json.Unmarshal(body, &leagues); err == nil {
+		return leagues, nil
+	}
+
+	var wrapped struct {
+		Leagues []leagueInfo `json:"leagues"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Leagues, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeagueConfig(t *testing.T) {
+	auto := parseLeagueConfig("auto", "Hardcore Sentinel")
+	require.True(t, auto.Tracked("Sentinel"))
+	require.True(t, auto.Tracked("SSF Sentinel"))
+	require.True(t, auto.Tracked(""))
+	require.False(t, auto.Tracked("Hardcore Sentinel"))
+	require.False(t, auto.Tracked("Standard"))
+	require.False(t, auto.Tracked("SSF Hardcore"))
+	require.False(t, auto.Tracked("My League (PL12345)"))
+
+	allow := parseLeagueConfig("Sentinel, Hardcore Sentinel", "")
+	require.True(t, allow.Tracked("Sentinel"))
+	require.True(t, allow.Tracked("Hardcore Sentinel"))
+	require.False(t, allow.Tracked("SSF Sentinel"))
+	require.ElementsMatch(t, []string{"Sentinel", "Hardcore Sentinel"}, allow.Configured())
+}
+
+func TestItemIndexName(t *testing.T) {
+	require.Equal(t, "items-archnemesis", itemIndexName("Archnemesis"))
+	require.Equal(t, "items-ssf-hardcore-sentinel", itemIndexName("SSF Hardcore Sentinel"))
+}
+
+func TestLeagueRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leagues.json")
+	writeLeagues := func(leagues string) {
+		require.NoError(t, os.WriteFile(path, []byte(leagues), 0644))
+	}
+	writeLeagues(`[
+		{"id": "Standard", "startAt": "2013-01-23T21:00:00Z", "endAt": null},
+		{"id": "Sentinel", "startAt": "2022-05-13T20:00:00Z", "endAt": null},
+		{"id": "Archnemesis", "startAt": "2022-02-04T20:00:00Z", "endAt": "2022-05-09T20:00:00Z"}
+	]`)
+
+	var created []string
+	registry := newLeagueRegistry(loadLeaguesFromFile(path), func(league string) error {
+		created = append(created, league)
+		return nil
+	})
+	config := parseLeagueConfig("auto", "")
+	config.registry = registry
+
+	// Until the registry loads, leagues are guessed from their names
+	require.True(t, config.Tracked("Archnemesis"))
+
+	require.NoError(t, registry.Refresh())
+	require.ElementsMatch(t, []string{"Standard", "Sentinel"}, created)
+	require.True(t, config.Tracked("Sentinel"))
+	require.False(t, config.Tracked("Standard"))
+	require.False(t, config.Tracked("Archnemesis"))
+	require.False(t, config.Tracked("Hardcore Sentinel"))
+
+	// New leagues are picked up on the next refresh
+	created = nil
+	writeLeagues(`{"leagues": [
+		{"id": "Sentinel", "startAt": "2022-05-13T20:00:00Z", "endAt": null},
+		{"id": "Hardcore Sentinel", "startAt": "2022-05-13T20:00:00Z", "endAt": null}
+	]}`)
+	require.NoError(t, registry.Refresh())
+	require.Equal(t, []string{"Hardcore Sentinel"}, created)
+	require.True(t, config.Tracked("Hardcore Sentinel"))
+}
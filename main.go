@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -13,23 +16,330 @@ const ESDateFormat = "2006-01-02T15:04:05-0700"
 var (
 	ESURL      = ""
 	DiscordURL = ""
+	StashURL   = ""
+	TokenURL   = ""
+	UserAgent  = ""
 )
 
 func main() {
+	mode := "index"
+	if len(os.Args) > 1 {
+		mode = os.Args[1]
+	}
+
 	ESURL = os.Getenv("ES_URL")
 	DiscordURL = os.Getenv("DISCORD_HOOK")
-	if ESURL == "" {
-		fmt.Println("ES_URL is not set")
-		os.Exit(1)
+	storage := os.Getenv("STORAGE")
+
+	StashURL = getEnvDefault("POE_STASH_URL", defaultStashURL)
+	TokenURL = getEnvDefault("POE_TOKEN_URL", defaultTokenURL)
+	clientID := os.Getenv("POE_CLIENT_ID")
+	clientSecret := os.Getenv("POE_CLIENT_SECRET")
+	contact := os.Getenv("POE_CONTACT")
+	UserAgent = getEnvDefault("POE_USER_AGENT", fmt.Sprintf("OAuth %s/1.0.0 (contact: %s)", clientID, contact))
+
+	// GGG requires stash API clients to identify themselves, so don't make any
+	// requests without a client ID and a contact for the User-Agent
+	if mode == "index" || mode == "record" {
+		if clientID == "" {
+			fmt.Println("POE_CLIENT_ID is not set")
+			os.Exit(1)
+		}
+		if contact == "" {
+			fmt.Println("POE_CONTACT is not set")
+			os.Exit(1)
+		}
 	}
 
+	TrackedLeagues = leagueConfigFromEnv()
+
+	fmt.Printf("STORAGE: %s\n", storage)
 	fmt.Printf("ES_URL: %s\n", ESURL)
 	fmt.Printf("DISCORD_HOOK: %s\n", DiscordURL)
+	fmt.Printf("POE_STASH_URL: %s\n", StashURL)
+	fmt.Printf("POE_TOKEN_URL: %s\n", TokenURL)
+	fmt.Printf("POE_USER_AGENT: %s\n", UserAgent)
+	fmt.Printf("LEAGUES: %s\n", TrackedLeagues)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var tokens *tokenSource
+	if clientID != "" {
+		tokens = newTokenSource(client, TokenURL, clientID, clientSecret, stashAPIScope)
+	}
+
+	ctx := shutdownContext()
+
+	if mode != "record" {
+		store, err := newStorage(storage, client)
+		if err != nil {
+			fmt.Printf("Error setting up storage: %v\n", err)
+			os.Exit(1)
+		}
+		Store = store
+
+		dlq, err := openDeadLetterQueueFromEnv()
+		if err != nil {
+			fmt.Printf("Error opening dead-letter queue: %v\n", err)
+			os.Exit(1)
+		}
+		DeadLetters = dlq
+		defer DeadLetters.Close()
+	}
+
+	if mode == "index" || mode == "replay" {
+		sinks, err := sinksFromEnv()
+		if err != nil {
+			fmt.Printf("Error setting up sinks: %v\n", err)
+			os.Exit(1)
+		}
+		Sinks = sinks
+		defer closeSinks()
+	}
+
+	if mode == "index" || mode == "replay" {
+		size, err := strconv.Atoi(getEnvDefault("FINGERPRINT_CACHE_SIZE", "2000000"))
+		if err != nil {
+			fmt.Printf("Invalid FINGERPRINT_CACHE_SIZE: %v\n", err)
+			os.Exit(1)
+		}
+		Fingerprints = newFingerprintCache(size)
+
+		if path := os.Getenv("FINGERPRINT_CACHE_FILE"); path != "" {
+			fmt.Printf("FINGERPRINT_CACHE_FILE: %s\n", path)
+			if err := Fingerprints.Load(path); err != nil {
+				fmt.Printf("Error loading fingerprint cache, starting empty: %v\n", err)
+				Fingerprints = newFingerprintCache(size)
+			} else {
+				fmt.Printf("Loaded %d item fingerprints\n", Fingerprints.Len())
+			}
+			defer saveFingerprints(path)
+		}
+	}
+
+	if mode == "index" || mode == "replay" {
+		window, err := time.ParseDuration(getEnvDefault("EXCHANGE_RATE_WINDOW", "24h"))
+		if err != nil {
+			fmt.Printf("Invalid EXCHANGE_RATE_WINDOW: %v\n", err)
+			os.Exit(1)
+		}
+		minSamples, err := strconv.Atoi(getEnvDefault("EXCHANGE_RATE_MIN_SAMPLES", "5"))
+		if err != nil {
+			fmt.Printf("Invalid EXCHANGE_RATE_MIN_SAMPLES: %v\n", err)
+			os.Exit(1)
+		}
+		saveInterval, err := time.ParseDuration(getEnvDefault("EXCHANGE_RATE_SAVE_INTERVAL", "5m"))
+		if err != nil {
+			fmt.Printf("Invalid EXCHANGE_RATE_SAVE_INTERVAL: %v\n", err)
+			os.Exit(1)
+		}
+
+		// Stored rates are loaded once storage is set up
+		Rates = newExchangeRates(window, minSamples)
+		go saveExchangeRatesLoop(ctx, saveInterval)
+		defer saveExchangeRates()
+	}
+
+	switch mode {
+	case "index":
+		setupStorage()
+		loadExchangeRates()
+		startLeagueRegistry(client)
+		runIndexer(ctx, client, tokens)
+	case "record":
+		// Record from the given change ID, falling back to the indexer's last
+		// position in the configured storage if there is one
+		startID := os.Getenv("RECORD_START_ID")
+		if startID == "" && (storage != "" || ESURL != "") {
+			store, err := newStorage(storage, client)
+			if err != nil {
+				fmt.Printf("Error setting up storage: %v\n", err)
+				os.Exit(1)
+			}
+			Store = store
+			if startID, err = Store.ChangeID(); err != nil {
+				fmt.Printf("Error reading the indexer's change ID: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		recordItems(ctx, client, newRateLimiter(), tokens, getEnvDefault("RECORD_DIR", "recordings"), startID)
+	case "replay":
+		speed, err := strconv.ParseFloat(getEnvDefault("REPLAY_SPEED", "1"), 64)
+		if err != nil {
+			fmt.Printf("Invalid REPLAY_SPEED: %v\n", err)
+			os.Exit(1)
+		}
+		setupStorage()
+		loadExchangeRates()
+		startLeagueRegistry(client)
+		runReplay(ctx, getEnvDefault("RECORD_DIR", "recordings"), speed)
+	case "dlq":
+		if len(os.Args) < 3 || os.Args[2] != "replay" {
+			fmt.Println("Usage: poe-indexer dlq replay")
+			os.Exit(1)
+		}
+		if err := replayDeadLetters(ctx, DeadLetters); err != nil {
+			fmt.Printf("Error replaying dead letters: %v\n", err)
+			os.Exit(1)
+		}
+	case "search":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: poe-indexer search <league> <query>")
+			os.Exit(1)
+		}
+		setupStorage()
+		if err := searchItems(os.Stdout, Store, os.Args[2], os.Args[3]); err != nil {
+			fmt.Printf("Error searching items: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Unknown mode %q, expected one of: index, record, replay, dlq, search\n", mode)
+		os.Exit(1)
+	}
+}
+
+// shutdownContext returns a context that's cancelled on SIGINT or SIGTERM so the
+// running mode can wind down cleanly. A second signal exits immediately.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		fmt.Printf("Got %v, finishing in-flight batches before shutting down (signal again to exit now)\n", sig)
+		cancel()
+
+		<-c
+		fmt.Println("Got second signal, exiting without finishing")
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+func openDeadLetterQueueFromEnv() (*deadLetterQueue, error) {
+	maxBytes, err := strconv.ParseInt(getEnvDefault("DLQ_MAX_BYTES", "67108864"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DLQ_MAX_BYTES: %v", err)
+	}
+	maxAge, err := time.ParseDuration(getEnvDefault("DLQ_MAX_AGE", "10m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DLQ_MAX_AGE: %v", err)
+	}
+
+	dir := getEnvDefault("DLQ_DIR", "dlq")
+	fmt.Printf("DLQ_DIR: %s\n", dir)
+	return openDeadLetterQueue(dir, maxBytes, maxAge)
+}
 
-	setupIndexes()
+// sinksFromEnv sets up the extra destinations for persisted batches that are enabled
+func sinksFromEnv() ([]batchSink, error) {
+	var sinks []batchSink
 
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		fmt.Printf("ARCHIVE_DIR: %s\n", dir)
+		archive, err := newParquetArchive(dir)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, archive)
+	}
+
+	if dir := os.Getenv("EVENT_LOG_DIR"); dir != "" {
+		maxBytes, err := strconv.ParseInt(getEnvDefault("EVENT_LOG_MAX_BYTES", "268435456"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EVENT_LOG_MAX_BYTES: %v", err)
+		}
+		maxFiles, err := strconv.Atoi(getEnvDefault("EVENT_LOG_MAX_FILES", "0"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid EVENT_LOG_MAX_FILES: %v", err)
+		}
+		fmt.Printf("EVENT_LOG_DIR: %s\n", dir)
+		events, err := openEventLog(dir, maxBytes, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, events)
+	}
+
+	if brokers := parseKafkaBrokers(os.Getenv("KAFKA_BROKERS")); len(brokers) > 0 {
+		topic := getEnvDefault("KAFKA_TOPIC", "poe-item-events")
+		fmt.Printf("KAFKA_BROKERS: %v\n", brokers)
+		fmt.Printf("KAFKA_TOPIC: %s\n", topic)
+		sinks = append(sinks, newKafkaPublisher(brokers, topic))
+	}
+
+	return sinks, nil
+}
+
+// saveFingerprints writes the fingerprint cache out on shutdown, so the next run
+// doesn't have to look every item up again
+func saveFingerprints(path string) {
+	if err := Fingerprints.Save(path); err != nil {
+		fmt.Printf("Error saving fingerprint cache: %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %d item fingerprints\n", Fingerprints.Len())
+}
+
+// setupStorage prepares the storage backend, along with any leagues that are
+// configured up front. Other leagues are set up as their stashes show up.
+func setupStorage() {
+	if err := Store.Setup(); err != nil {
+		panic(err)
+	}
+	for _, league := range TrackedLeagues.Configured() {
+		if err := Store.EnsureLeague(league); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// loadExchangeRates picks up the rates saved by the last run, to use until enough
+// listings have been seen to work out new ones
+func loadExchangeRates() {
+	rates, err := Store.ExchangeRates()
+	if err != nil {
+		fmt.Printf("Error loading exchange rates, starting from the defaults: %v\n", err)
+		return
+	}
+	Rates.Load(rates)
+	fmt.Printf("Loaded %d exchange rates\n", len(rates))
+}
+
+// startLeagueRegistry keeps track of the active leagues when they're being
+// auto-detected, creating indexes for new leagues as they start
+func startLeagueRegistry(client *http.Client) {
+	if !TrackedLeagues.auto {
+		return
+	}
+
+	load := loadLeaguesFromURL(client, getEnvDefault("POE_LEAGUES_URL", defaultLeaguesURL))
+	if path := os.Getenv("LEAGUES_FILE"); path != "" {
+		load = loadLeaguesFromFile(path)
+	}
+	interval, err := time.ParseDuration(getEnvDefault("LEAGUES_REFRESH_INTERVAL", "10m"))
+	if err != nil {
+		fmt.Printf("Invalid LEAGUES_REFRESH_INTERVAL: %v\n", err)
+		os.Exit(1)
+	}
+
+	registry := newLeagueRegistry(load, func(league string) error {
+		if !TrackedLeagues.allowed(league) {
+			return nil
+		}
+		return Store.EnsureLeague(league)
+	})
+	if err := registry.Refresh(); err != nil {
+		fmt.Printf("Error loading leagues, guessing from league names until they load: %v\n", err)
+	}
+	TrackedLeagues.registry = registry
+
+	go leagueRefreshLoop(registry, interval)
+}
+
+func runIndexer(ctx context.Context, client *http.Client, tokens *tokenSource) {
 	// Set up the indexer to track items with a price from our chosen league
-	client := &http.Client{Timeout: 30 * time.Second}
 	fetchCh := make(chan itemUpdate, 4)
 	formatCh := make(chan itemUpdate, 4)
 	prunedItemsCh := make(chan itemUpdate, 4)
@@ -42,24 +352,38 @@ func main() {
 		2. Filter out the items from other leagues and format them for ES.
 		3. (optional) Compare to existing items to avoid no-op writes.
 		4. Diff the stash contents against their last known state to get removed items.
-		5. Persist the created/updated/deleted items to ES.
-		6. Update the last seen change ID and store it in ES.
+		5. Persist the created/updated/deleted items to storage.
+		6. Update the last seen change ID and save it to storage.
 	*/
-	go fetchItems(client, fetchCh)
-	go formatStashLoop(fetchCh, formatCh)
-	go lookupItemLoop(formatCh, prunedItemsCh)
-	go diffStashLoop(client, prunedItemsCh, persistCh)
-	go persistItemLoop(persistCh, changeCh)
+	go fetchItems(ctx, client, newRateLimiter(), tokens, fetchCh)
+	go formatStashLoop(ctx, fetchCh, formatCh)
+	go lookupItemLoop(ctx, formatCh, prunedItemsCh)
+	go diffStashLoop(ctx, prunedItemsCh, persistCh)
+	go persistItemLoop(ctx, persistCh, changeCh)
 	//go expensiveSoldItemAlertLoop()
-	updateChangeIDLoop(client, changeCh)
 
-	// Wait for interrupt signal
-	c := make(chan os.Signal, 1)
-	signal.Notify(c)
+	// Returns once every stage has drained after ctx is cancelled
+	updateChangeIDLoop(changeCh)
+	fmt.Println("Shut down cleanly")
+}
 
-	// Block and shutdown on receiving any signal
-	<-c
-	fmt.Println("Got signal, shutting down")
+// runReplay feeds recorded pages through the same stages as the indexer, without
+// touching the stash API or the stored change ID. It returns once the recording has
+// been replayed or ctx is cancelled.
+func runReplay(ctx context.Context, dir string, speed float64) {
+	replayCh := make(chan itemUpdate, 4)
+	formatCh := make(chan itemUpdate, 4)
+	prunedItemsCh := make(chan itemUpdate, 4)
+	persistCh := make(chan itemUpdate, 4)
+	changeCh := make(chan string, 4)
 
-	os.Exit(1)
+	go replayItems(ctx, dir, speed, replayCh)
+	go formatStashLoop(ctx, replayCh, formatCh)
+	go lookupItemLoop(ctx, formatCh, prunedItemsCh)
+	go diffStashLoop(ctx, prunedItemsCh, persistCh)
+	go persistItemLoop(ctx, persistCh, changeCh)
+
+	for changeID := range changeCh {
+		fmt.Printf("Replayed through change ID %s\n", changeID)
+	}
 }
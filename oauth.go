@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStashURL = "https://api.pathofexile.com/public-stash-tabs"
+	defaultTokenURL = "https://www.pathofexile.com/oauth/token"
+
+	stashAPIScope = "service:psapi"
+
+	// Refresh tokens this long before they're due to expire
+	tokenExpiryMargin = time.Minute
+)
+
+// tokenSource fetches OAuth service tokens using the client credentials grant and
+// caches them until they're close to expiring.
+type tokenSource struct {
+	client       *http.Client
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scope        string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   *int   `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+}
+
+func newTokenSource(client *http.Client, tokenURL, clientID, clientSecret, scope string) *tokenSource {
+	return &tokenSource{
+		client:       client,
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scope:        scope,
+	}
+}
+
+// Token returns a valid access token, requesting a new one if the cached token is
+// missing or about to expire.
+func (s *tokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && (s.expiry.IsZero() || time.Now().Add(tokenExpiryMargin).Before(s.expiry)) {
+		return s.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("client_id", s.clientID)
+	form.Set("client_secret", s.clientSecret)
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", s.scope)
+
+	req, err := http.NewRequest("POST", s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode >= 400 {
+		log.Printf("Error: status code %d", resp.StatusCode)
+		log.Println("Response Body:", string(body))
+		return "", fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return "", err
+	}
+	if tr.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response")
+	}
+
+	// Service tokens may be issued without an expiry, in which case we keep using
+	// the token until the API rejects it
+	s.token = tr.AccessToken
+	s.expiry = time.Time{}
+	if tr.ExpiresIn != nil {
+		s.expiry = time.Now().Add(time.Duration(*tr.ExpiresIn) * time.Second)
+	}
+	fmt.Printf("Fetched new OAuth token with scope %q (expires: %v)\n", tr.Scope, s.expiry)
+
+	return s.token, nil
+}
+
+// Invalidate drops the cached token so the next call to Token fetches a new one
+func (s *tokenSource) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = ""
+	s.expiry = time.Time{}
+}
+
+// authorize sets the headers required by the PoE API on a request, including a bearer
+// token if OAuth credentials are configured.
+func authorize(req *http.Request, tokens *tokenSource) error {
+	req.Header.Set("User-Agent", UserAgent)
+	if tokens == nil {
+		return nil
+	}
+
+	token, err := tokens.Token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
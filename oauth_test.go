@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSource(t *testing.T) {
+	// The handler runs on the server's goroutine, so it passes each request's form
+	// back to be checked here rather than failing the test itself
+	forms := make(chan url.Values, 2)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("parsing token request: %v", err)
+		}
+		forms <- r.Form
+
+		requests++
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600,"token_type":"bearer","scope":"%s"}`, requests, stashAPIScope)
+	}))
+	defer server.Close()
+
+	tokens := newTokenSource(server.Client(), server.URL, "indexer", "secret", stashAPIScope)
+
+	// The token should be cached until it's invalidated
+	token, err := tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token)
+
+	token, err = tokens.Token()
+	require.NoError(t, err)
+	require.Equal(t, "token-1", token)
+	require.Equal(t, 1, requests)
+
+	form := <-forms
+	require.Equal(t, "client_credentials", form.Get("grant_type"))
+	require.Equal(t, "indexer", form.Get("client_id"))
+	require.Equal(t, "secret", form.Get("client_secret"))
+	require.Equal(t, stashAPIScope, form.Get("scope"))
+
+	tokens.Invalidate()
+	req, _ := http.NewRequest("GET", "http://localhost/public-stash-tabs", nil)
+	require.NoError(t, authorize(req, tokens))
+	require.Equal(t, "Bearer token-2", req.Header.Get("Authorization"))
+	require.Equal(t, "indexer", (<-forms).Get("client_id"))
+}
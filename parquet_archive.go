@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Datasets in the archive, each in its own directory
+const (
+	archiveItems         = "items"
+	archiveRemovals      = "removals"
+	archiveStashMappings = "stash_mappings"
+)
+
+// A snapshot of an item as it was created or updated
+type archivedItem struct {
+	ChangeID      string  `parquet:"name=change_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp     int64   `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	League        string  `parquet:"name=league, type=BYTE_ARRAY, convertedtype=UTF8"`
+	StashID       string  `parquet:"name=stash_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Account       string  `parquet:"name=account, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ItemID        string  `parquet:"name=item_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Created       bool    `parquet:"name=created, type=BOOLEAN"`
+	Name          string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TypeLine      string  `parquet:"name=type_line, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BaseType      string  `parquet:"name=base_type, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PriceValue    float64 `parquet:"name=price_value, type=DOUBLE"`
+	PriceCurrency string  `parquet:"name=price_currency, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PriceChaos    float64 `parquet:"name=price_chaos, type=DOUBLE"`
+	Doc           string  `parquet:"name=doc, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type archivedRemoval struct {
+	ChangeID  string `parquet:"name=change_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp int64  `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	League    string `parquet:"name=league, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ItemID    string `parquet:"name=item_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type archivedStashMapping struct {
+	ChangeID  string   `parquet:"name=change_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp int64    `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	League    string   `parquet:"name=league, type=BYTE_ARRAY, convertedtype=UTF8"`
+	StashID   string   `parquet:"name=stash_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Account   string   `parquet:"name=account, type=BYTE_ARRAY, convertedtype=UTF8"`
+	StashName string   `parquet:"name=stash_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ItemIDs   []string `parquet:"name=item_ids, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// parquetArchive writes every persisted batch to Parquet files partitioned by date, with
+// a file per dataset for each batch, e.g. items/date=2022-05-20/part-1-2-3.parquet. A
+// batch's files are written to temporary names and only renamed into place once all of
+// them are complete, so anything with a .parquet extension is safe to read and a batch is
+// only acknowledged once it's on disk. Files are named after the batch's change ID, so a
+// batch that's retried or replayed replaces its earlier files instead of duplicating
+// their rows.
+type parquetArchive struct {
+	dir string
+}
+
+func newParquetArchive(dir string) (*parquetArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Files left over from a batch that was being written when the indexer stopped.
+	// The batch was never acknowledged, so it gets written again in full.
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*", "date=*", "*.parquet.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range leftovers {
+		fmt.Printf("Removing unfinished archive file %s\n", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return &parquetArchive{dir: dir}, nil
+}
+
+func (a *parquetArchive) WriteBatch(batch persistedBatch) error {
+	ts := batch.Time.UnixNano() / int64(time.Millisecond)
+
+	var items, mappings, removals []interface{}
+	for _, stash := range batch.Stashes {
+		for _, item := range stash.FormattedItems {
+			doc, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			items = append(items, archivedItem{
+				ChangeID:      batch.ChangeID,
+				Timestamp:     ts,
+				League:        stash.League,
+				StashID:       stash.ID,
+				Account:       stash.AccountName,
+				ItemID:        item.ID,
+				Created:       item.create,
+				Name:          item.Name,
+				TypeLine:      item.TypeLine,
+				BaseType:      item.BaseType,
+				PriceValue:    float64(item.PriceValue),
+				PriceCurrency: item.PriceCurrency,
+				PriceChaos:    float64(item.PriceChaos),
+				Doc:           string(doc),
+			})
+		}
+
+		itemIDs := stash.ItemIDs
+		if itemIDs == nil {
+			itemIDs = []string{}
+		}
+		mappings = append(mappings, archivedStashMapping{
+			ChangeID:  batch.ChangeID,
+			Timestamp: ts,
+			League:    stash.League,
+			StashID:   stash.ID,
+			Account:   stash.AccountName,
+			StashName: stash.Stash,
+			ItemIDs:   itemIDs,
+		})
+	}
+
+	for _, removed := range batch.Deletes {
+		removals = append(removals, archivedRemoval{
+			ChangeID:  batch.ChangeID,
+			Timestamp: ts,
+			League:    removed.League,
+			ItemID:    removed.ID,
+		})
+	}
+
+	datasets := []struct {
+		name   string
+		schema interface{}
+		rows   []interface{}
+	}{
+		{archiveItems, new(archivedItem), items},
+		{archiveStashMappings, new(archivedStashMapping), mappings},
+		{archiveRemovals, new(archivedRemoval), removals},
+	}
+
+	// Only rename the files once every dataset is written, so a failed batch leaves
+	// nothing readable behind
+	var paths []string
+	for _, dataset := range datasets {
+		if len(dataset.rows) == 0 {
+			continue
+		}
+		path, err := a.writeFile(dataset.name, dataset.schema, batch, dataset.rows)
+		if err != nil {
+			for _, written := range paths {
+				os.Remove(written + ".tmp")
+			}
+			return err
+		}
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes a batch's rows for a dataset to a finished file under a temporary
+// name, returning the path it should be renamed to. The temporary file is removed if
+// the write fails.
+func (a *parquetArchive) writeFile(dataset string, schema interface{}, batch persistedBatch, rows []interface{}) (string, error) {
+	dir := filepath.Join(a.dir, dataset, "date="+batch.Time.UTC().Format("2006-01-02"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, "part-"+batch.ChangeID+".parquet")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(path + ".tmp")
+		return "", fmt.Errorf("writing %s: %v", path, err)
+	}
+
+	pw, err := writer.NewParquetWriterFromWriter(f, schema, 1)
+	if err != nil {
+		return fail(err)
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			return fail(err)
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	return path, nil
+}
+
+// Close does nothing, since every batch's files are finished as it's written
+func (a *parquetArchive) Close() error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// localParquetFile lets the Parquet reader open files from disk
+type localParquetFile struct {
+	*os.File
+}
+
+func (f localParquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	file, err := os.Open(name)
+	return localParquetFile{file}, err
+}
+
+func (f localParquetFile) Create(name string) (source.ParquetFile, error) {
+	file, err := os.Create(name)
+	return localParquetFile{file}, err
+}
+
+func readParquetRows(t *testing.T, pattern string, schema, rows interface{}, numRows int) {
+	paths, err := filepath.Glob(pattern)
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+
+	f, err := os.Open(paths[0])
+	require.NoError(t, err)
+	defer f.Close()
+
+	pr, err := reader.NewParquetReader(localParquetFile{f}, schema, 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+	require.Equal(t, int64(numRows), pr.GetNumRows())
+	require.NoError(t, pr.Read(rows))
+}
+
+func TestParquetArchive(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := newParquetArchive(dir)
+	require.NoError(t, err)
+
+	stash := testStash(t, "item1", "item2")
+	stash.FormattedItems[0].create = true
+	batchTime := time.Date(2022, 5, 20, 15, 4, 5, 0, time.UTC)
+	batch := persistedBatch{
+		ChangeID: "1-1-1",
+		Time:     batchTime,
+		Stashes:  []PlayerStash{stash},
+		Deletes:  []itemRef{{ID: "item3", League: "Sentinel"}},
+	}
+
+	// A retried batch replaces its files rather than adding its rows again
+	require.NoError(t, archive.WriteBatch(batch))
+	require.NoError(t, archive.WriteBatch(batch))
+	require.NoError(t, archive.Close())
+
+	items := make([]archivedItem, 2)
+	readParquetRows(t, filepath.Join(dir, archiveItems, "date=2022-05-20", "*.parquet"), new(archivedItem), &items, 2)
+	require.Equal(t, "1-1-1", items[0].ChangeID)
+	require.Equal(t, batchTime.UnixNano()/int64(time.Millisecond), items[0].Timestamp)
+	require.Equal(t, "item1", items[0].ItemID)
+	require.True(t, items[0].Created)
+	require.False(t, items[1].Created)
+	require.Equal(t, "Rapture Nock", items[0].Name)
+	require.Equal(t, 15.0, items[0].PriceValue)
+	require.Equal(t, "chaos", items[0].PriceCurrency)
+
+	removals := make([]archivedRemoval, 1)
+	readParquetRows(t, filepath.Join(dir, archiveRemovals, "date=2022-05-20", "*.parquet"), new(archivedRemoval), &removals, 1)
+	require.Equal(t, archivedRemoval{ChangeID: "1-1-1", Timestamp: items[0].Timestamp, League: "Sentinel", ItemID: "item3"}, removals[0])
+
+	mappings := make([]archivedStashMapping, 1)
+	readParquetRows(t, filepath.Join(dir, archiveStashMappings, "date=2022-05-20", "*.parquet"), new(archivedStashMapping), &mappings, 1)
+	require.Equal(t, "stash1", mappings[0].StashID)
+	require.Equal(t, []string{"item1", "item2"}, mappings[0].ItemIDs)
+}
+
+func TestParquetArchiveLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, archiveItems, "date=2022-05-20", "part-1-1-1.parquet.tmp")
+	require.NoError(t, os.MkdirAll(filepath.Dir(partial), 0755))
+	require.NoError(t, os.WriteFile(partial, []byte("PAR1"), 0644))
+
+	// A file from a batch that was cut off is removed, since the batch gets written again
+	_, err := newParquetArchive(dir)
+	require.NoError(t, err)
+	_, err = os.Stat(partial)
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Price tags, as the game writes them after the ~ in a note
+const (
+	priceTypeBuyout = "b/o"
+	priceTypeFixed  = "price"
+	priceTypeSkip   = "skip"
+)
+
+// Where an item's price came from
+const (
+	priceSourceNote = "note"
+	priceSourceTab  = "tab"
+)
+
+// The amount and currency after a price tag, e.g. "1.5 divine" or "3/10 chaos orbs".
+// Anything after the currency is a comment.
+var priceAmount = regexp.MustCompile(`^(\d+(?:\.\d+)?|\.\d+)(?:/(\d+(?:\.\d+)?))?\s*([a-z']+)(?:\s+orbs?\b)?`)
+
+// The names and abbreviations players use for currencies in notes, mapped to the
+// names used in the index
+var currencyAliases = map[string]string{
+	"c":          "chaos",
+	"chaos":      "chaos",
+	"ex":         "exalted",
+	"exa":        "exalted",
+	"exalt":      "exalted",
+	"exalts":     "exalted",
+	"exalted":    "exalted",
+	"div":        "divine",
+	"divs":       "divine",
+	"divine":     "divine",
+	"divines":    "divine",
+	"mirror":     "mirror",
+	"mirrors":    "mirror",
+	"kalandra":   "mirror",
+	"alch":       "alch",
+	"alchs":      "alch",
+	"alchemy":    "alch",
+	"fuse":       "fusing",
+	"fuses":      "fusing",
+	"fusing":     "fusing",
+	"fusings":    "fusing",
+	"alt":        "alt",
+	"alts":       "alt",
+	"alteration": "alt",
+	"jew":        "jewellers",
+	"jewellers":  "jewellers",
+	"jeweller's": "jewellers",
+	"chrom":      "chrome",
+	"chrome":     "chrome",
+	"chromes":    "chrome",
+	"chromatic":  "chrome",
+	"chance":     "chance",
+	"chances":    "chance",
+	"regret":     "regret",
+	"regrets":    "regret",
+	"scour":      "scour",
+	"scours":     "scour",
+	"scouring":   "scour",
+	"annul":      "annul",
+	"annuls":     "annul",
+	"annulment":  "annul",
+	"regal":      "regal",
+	"regals":     "regal",
+	"vaal":       "vaal",
+	"blessed":    "blessed",
+	"gcp":        "gcp",
+	"gemcutters": "gcp",
+	"chisel":     "chisel",
+	"chisels":    "chisel",
+	"bauble":     "bauble",
+	"baubles":    "bauble",
+	"horizon":    "horizon",
+	"horizons":   "horizon",
+}
+
+// A price read from a note. Value is paid for Quantity of the item, so "~price 3/10
+// chaos" on a stack of currency sells 10 of it for 3 chaos. Prices on stackable items
+// are for each item in the stack, not the stack as a whole.
+type notePrice struct {
+	Type     string
+	Value    float64
+	Quantity float64
+	Currency string
+}
+
+// PerUnit returns the price of a single item
+func (p notePrice) PerUnit() float64 {
+	return p.Value / p.Quantity
+}
+
+// parsePriceNote reads the price from an item or stash note. Notes that don't start with
+// a ~ tag aren't prices, and return false. Notes with a tag that can't be read return
+// an error rather than a guess at the price. ~skip notes have a type but no price.
+func parsePriceNote(note string) (notePrice, bool, error) {
+	note = strings.ToLower(strings.TrimSpace(note))
+	if !strings.HasPrefix(note, "~") {
+		return notePrice{}, false, nil
+	}
+
+	tag := note
+	rest := ""
+	if i := strings.IndexAny(note, " \t"); i != -1 {
+		tag, rest = note[:i], strings.TrimSpace(note[i:])
+	}
+	price := notePrice{Type: strings.TrimPrefix(tag, "~")}
+	switch price.Type {
+	case priceTypeSkip:
+		return price, true, nil
+	case priceTypeBuyout, priceTypeFixed:
+	default:
+		return notePrice{}, true, fmt.Errorf("unknown price tag %q", tag)
+	}
+
+	matches := priceAmount.FindStringSubmatch(rest)
+	if matches == nil {
+		return notePrice{}, true, fmt.Errorf("can't read a price from %q", rest)
+	}
+
+	price.Value, _ = strconv.ParseFloat(matches[1], 64)
+	price.Quantity = 1
+	if matches[2] != "" {
+		price.Quantity, _ = strconv.ParseFloat(matches[2], 64)
+	}
+	if price.Value <= 0 || price.Quantity <= 0 {
+		return notePrice{}, true, fmt.Errorf("price %q isn't positive", matches[0])
+	}
+
+	currency, ok := currencyAliases[matches[3]]
+	if !ok {
+		return notePrice{}, true, fmt.Errorf("unknown currency %q", matches[3])
+	}
+	price.Currency = currency
+
+	return price, true, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePriceNote(t *testing.T) {
+	for _, tc := range []struct {
+		note  string
+		price notePrice
+	}{
+		{"~price 15 chaos", notePrice{Type: priceTypeFixed, Value: 15, Quantity: 1, Currency: "chaos"}},
+		{"~b/o 1.5 divine", notePrice{Type: priceTypeBuyout, Value: 1.5, Quantity: 1, Currency: "divine"}},
+		{"~b/o 1.5div", notePrice{Type: priceTypeBuyout, Value: 1.5, Quantity: 1, Currency: "divine"}},
+		{"~price 3/10 chaos", notePrice{Type: priceTypeFixed, Value: 3, Quantity: 10, Currency: "chaos"}},
+		{"~price 2 ex, no lowballs", notePrice{Type: priceTypeFixed, Value: 2, Quantity: 1, Currency: "exalted"}},
+		{"~B/O 40 c", notePrice{Type: priceTypeBuyout, Value: 40, Quantity: 1, Currency: "chaos"}},
+		{"~price 1 Chaos Orb", notePrice{Type: priceTypeFixed, Value: 1, Quantity: 1, Currency: "chaos"}},
+		{"~skip", notePrice{Type: priceTypeSkip}},
+	} {
+		price, ok, err := parsePriceNote(tc.note)
+		require.NoError(t, err, tc.note)
+		require.True(t, ok, tc.note)
+		require.Equal(t, tc.price, price, tc.note)
+	}
+
+	// Notes without a tag aren't prices
+	for _, note := range []string{"", "Stash35", "offers welcome", "15 chaos"} {
+		_, ok, err := parsePriceNote(note)
+		require.NoError(t, err, note)
+		require.False(t, ok, note)
+	}
+
+	// Tagged notes that can't be read are errors rather than a guess
+	for _, note := range []string{"~price", "~price lots", "~b/o 1,5 divine", "~price 5 shinies", "~price 0 chaos", "~price 1/0 chaos", "~offer 5 chaos"} {
+		_, ok, err := parsePriceNote(note)
+		require.Error(t, err, note)
+		require.True(t, ok, note)
+	}
+
+	price, _, _ := parsePriceNote("~price 3/10 chaos")
+	require.Equal(t, 0.3, price.PerUnit())
+}
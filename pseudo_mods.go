@@ -0,0 +1,113 @@
+package main
+
+import "strings"
+
+// PseudoMods are totals of stats across all of an item's mods, like the pseudo stats
+// on the trade site, so they can be searched without adding up mods in a query
+type PseudoMods struct {
+	Life          JSONDouble `json:"totalLife,omitempty"`
+	EnergyShield  JSONDouble `json:"totalEnergyShield,omitempty"`
+	Strength      JSONDouble `json:"totalStrength,omitempty"`
+	Dexterity     JSONDouble `json:"totalDexterity,omitempty"`
+	Intelligence  JSONDouble `json:"totalIntelligence,omitempty"`
+	Attributes    JSONDouble `json:"totalAttributes,omitempty"`
+	FireRes       JSONDouble `json:"totalFireResistance,omitempty"`
+	ColdRes       JSONDouble `json:"totalColdResistance,omitempty"`
+	LightningRes  JSONDouble `json:"totalLightningResistance,omitempty"`
+	ChaosRes      JSONDouble `json:"totalChaosResistance,omitempty"`
+	ElementalRes  JSONDouble `json:"totalElementalResistance,omitempty"`
+	Resistance    JSONDouble `json:"totalResistance,omitempty"`
+	MovementSpeed JSONDouble `json:"movementSpeed,omitempty"`
+}
+
+// The stats that pseudo mods are built up from
+const (
+	pseudoLife = iota
+	pseudoEnergyShield
+	pseudoStrength
+	pseudoDexterity
+	pseudoIntelligence
+	pseudoFireRes
+	pseudoColdRes
+	pseudoLightningRes
+	pseudoChaosRes
+	pseudoMovementSpeed
+	pseudoStatCount
+)
+
+// The stats each mod adds its value to, keyed by the mod's text with its leading + dropped
+var pseudoModStats = map[string][]int{
+	"# to maximum Life":          {pseudoLife},
+	"# to maximum Energy Shield": {pseudoEnergyShield},
+
+	"# to Strength":                   {pseudoStrength},
+	"# to Dexterity":                  {pseudoDexterity},
+	"# to Intelligence":               {pseudoIntelligence},
+	"# to Strength and Dexterity":     {pseudoStrength, pseudoDexterity},
+	"# to Strength and Intelligence":  {pseudoStrength, pseudoIntelligence},
+	"# to Dexterity and Intelligence": {pseudoDexterity, pseudoIntelligence},
+	"# to all Attributes":             {pseudoStrength, pseudoDexterity, pseudoIntelligence},
+
+	"#% to Fire Resistance":                 {pseudoFireRes},
+	"#% to Cold Resistance":                 {pseudoColdRes},
+	"#% to Lightning Resistance":            {pseudoLightningRes},
+	"#% to Chaos Resistance":                {pseudoChaosRes},
+	"#% to Fire and Cold Resistances":       {pseudoFireRes, pseudoColdRes},
+	"#% to Fire and Lightning Resistances":  {pseudoFireRes, pseudoLightningRes},
+	"#% to Cold and Lightning Resistances":  {pseudoColdRes, pseudoLightningRes},
+	"#% to Fire and Chaos Resistances":      {pseudoFireRes, pseudoChaosRes},
+	"#% to Cold and Chaos Resistances":      {pseudoColdRes, pseudoChaosRes},
+	"#% to Lightning and Chaos Resistances": {pseudoLightningRes, pseudoChaosRes},
+	"#% to all Elemental Resistances":       {pseudoFireRes, pseudoColdRes, pseudoLightningRes},
+	"#% to all Resistances":                 {pseudoFireRes, pseudoColdRes, pseudoLightningRes, pseudoChaosRes},
+
+	"#% increased Movement Speed": {pseudoMovementSpeed},
+	"#% reduced Movement Speed":   {pseudoMovementSpeed},
+}
+
+// Mods whose value takes away from their stats
+var negatedPseudoMods = map[string]bool{
+	"#% reduced Movement Speed": true,
+}
+
+// computePseudoMods adds up the stats from an item's enchant, implicit, fractured,
+// explicit and crafted mods, or returns nil if none of them add to any. Life includes
+// the 1 life per 2 strength that the trade site counts too.
+func computePseudoMods(item *IndexedItem) *PseudoMods {
+	var stats [pseudoStatCount]float64
+	for _, mods := range [][]Modifier{item.EnchantMods, item.ImplicitMods, item.FracturedMods, item.ExplicitMods, item.CraftedMods} {
+		for _, mod := range mods {
+			if len(mod.Values) != 1 {
+				continue
+			}
+			text := strings.TrimPrefix(mod.Text, "+")
+			value := float64(mod.Values[0])
+			if negatedPseudoMods[text] {
+				value = -value
+			}
+			for _, stat := range pseudoModStats[text] {
+				stats[stat] += value
+			}
+		}
+	}
+
+	pseudo := PseudoMods{
+		Life:          JSONDouble(stats[pseudoLife] + stats[pseudoStrength]/2),
+		EnergyShield:  JSONDouble(stats[pseudoEnergyShield]),
+		Strength:      JSONDouble(stats[pseudoStrength]),
+		Dexterity:     JSONDouble(stats[pseudoDexterity]),
+		Intelligence:  JSONDouble(stats[pseudoIntelligence]),
+		Attributes:    JSONDouble(stats[pseudoStrength] + stats[pseudoDexterity] + stats[pseudoIntelligence]),
+		FireRes:       JSONDouble(stats[pseudoFireRes]),
+		ColdRes:       JSONDouble(stats[pseudoColdRes]),
+		LightningRes:  JSONDouble(stats[pseudoLightningRes]),
+		ChaosRes:      JSONDouble(stats[pseudoChaosRes]),
+		ElementalRes:  JSONDouble(stats[pseudoFireRes] + stats[pseudoColdRes] + stats[pseudoLightningRes]),
+		MovementSpeed: JSONDouble(stats[pseudoMovementSpeed]),
+	}
+	pseudo.Resistance = pseudo.ElementalRes + pseudo.ChaosRes
+	if pseudo == (PseudoMods{}) {
+		return nil
+	}
+	return &pseudo
+}
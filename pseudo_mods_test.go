@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputePseudoMods(t *testing.T) {
+	item := Item{}
+	item.ImplicitMods = []string{"+12% to all Elemental Resistances"}
+	item.FracturedMods = []string{"+40 to Strength"}
+	item.ExplicitMods = []string{
+		"+70 to maximum Life",
+		"+30% to Fire Resistance",
+		"+20% to Fire and Cold Resistances",
+		"-10% to Chaos Resistance",
+		"+15 to all Attributes",
+		"25% increased Movement Speed",
+	}
+	item.CraftedMods = []string{"+25% to Cold and Lightning Resistances", "+8% to all Resistances"}
+
+	pseudo := item.ToIndexedItem("").PseudoMods
+	require.NotNil(t, pseudo)
+	require.Equal(t, PseudoMods{
+		Life:          97.5,
+		Strength:      55,
+		Dexterity:     15,
+		Intelligence:  15,
+		Attributes:    85,
+		FireRes:       70,
+		ColdRes:       65,
+		LightningRes:  45,
+		ChaosRes:      -2,
+		ElementalRes:  180,
+		Resistance:    178,
+		MovementSpeed: 25,
+	}, *pseudo)
+
+	// Items with nothing to add up don't get pseudo mods
+	item = Item{}
+	item.ExplicitMods = []string{"Adds 10 to 20 Cold Damage"}
+	require.Nil(t, item.ToIndexedItem("").PseudoMods)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pacing used until the API has told us what its actual limits are
+const defaultRequestInterval = 500 * time.Millisecond
+
+// A single hits:period:restriction rule from the X-Rate-Limit-<rule> headers, along with
+// the matching hits:period:restricted values from X-Rate-Limit-<rule>-State
+type rateLimitRule struct {
+	Hits        int
+	Period      time.Duration
+	Restriction time.Duration
+
+	CurrentHits int
+	Restricted  time.Duration
+}
+
+// RateLimitBudget describes how much of a single rule's budget has been used
+type RateLimitBudget struct {
+	Rule   string
+	Used   int
+	Hits   int
+	Period time.Duration
+}
+
+func (b RateLimitBudget) String() string {
+	return fmt.Sprintf("%s %d/%d per %v", b.Rule, b.Used, b.Hits, b.Period)
+}
+
+// rateLimiter paces requests to the PoE API according to the limits the API reports
+// in its X-Rate-Limit-* headers, honoring Retry-After on 429s and backing off with
+// jitter on server errors.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	policy       string
+	rules        map[string][]rateLimitRule
+	history      []time.Time
+	blockedUntil time.Time
+	failures     int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		rules: make(map[string][]rateLimitRule),
+	}
+}
+
+// Wait blocks until another request can be made without exceeding the known limits,
+// and records the request against the budget. It returns early with the context's
+// error if ctx is cancelled first.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		delay := l.delay(now)
+		if delay <= 0 {
+			l.history = append(l.history, now)
+			l.mu.Unlock()
+			return nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// delay returns how long to wait from now until the next request is allowed.
+// Must be called with l.mu held.
+func (l *rateLimiter) delay(now time.Time) time.Duration {
+	wait := l.blockedUntil.Sub(now)
+
+	if len(l.rules) == 0 {
+		if len(l.history) > 0 {
+			l.history = l.history[len(l.history)-1:]
+			if d := l.history[len(l.history)-1].Add(defaultRequestInterval).Sub(now); d > wait {
+				wait = d
+			}
+		}
+		return wait
+	}
+
+	// Drop history older than the longest period we need to track
+	var longest time.Duration
+	for _, rules := range l.rules {
+		for _, rule := range rules {
+			if rule.Period > longest {
+				longest = rule.Period
+			}
+		}
+	}
+	cutoff := 0
+	for cutoff < len(l.history) && now.Sub(l.history[cutoff]) >= longest {
+		cutoff++
+	}
+	l.history = l.history[cutoff:]
+
+	for _, rules := range l.rules {
+		for _, rule := range rules {
+			if rule.Hits <= 0 {
+				continue
+			}
+
+			// Find the requests made within this rule's window; if the window is full,
+			// we have to wait for the oldest of them to fall out of it.
+			inWindow := 0
+			for i := len(l.history) - 1; i >= 0 && now.Sub(l.history[i]) < rule.Period; i-- {
+				inWindow++
+			}
+			if inWindow >= rule.Hits {
+				oldest := l.history[len(l.history)-rule.Hits]
+				if d := oldest.Add(rule.Period).Sub(now); d > wait {
+					wait = d
+				}
+			}
+		}
+	}
+
+	return wait
+}
+
+// Update adjusts the limiter from the headers and status of an API response.
+func (l *rateLimiter) Update(resp *http.Response) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.parseHeaders(resp.Header, now)
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if retryAfter <= 0 {
+			retryAfter = l.backoff()
+		}
+		l.blockUntil(now.Add(retryAfter))
+	case resp.StatusCode >= 500:
+		l.blockUntil(now.Add(l.backoff()))
+	case resp.StatusCode < 400:
+		l.failures = 0
+	}
+}
+
+// Failure backs off after a request that didn't get a response at all.
+func (l *rateLimiter) Failure() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.blockUntil(time.Now().Add(l.backoff()))
+}
+
+// Budget returns the current usage of each rule the API has reported, sorted by rule
+// and then by window.
+func (l *rateLimiter) Budget() []RateLimitBudget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var budget []RateLimitBudget
+	for name, rules := range l.rules {
+		for _, rule := range rules {
+			budget = append(budget, RateLimitBudget{
+				Rule:   name,
+				Used:   rule.CurrentHits,
+				Hits:   rule.Hits,
+				Period: rule.Period,
+			})
+		}
+	}
+	sort.Slice(budget, func(i, j int) bool {
+		if budget[i].Rule != budget[j].Rule {
+			return budget[i].Rule < budget[j].Rule
+		}
+		return budget[i].Period < budget[j].Period
+	})
+	return budget
+}
+
+func (l *rateLimiter) blockUntil(t time.Time) {
+	if t.After(l.blockedUntil) {
+		l.blockedUntil = t
+	}
+}
+
+// backoff returns the delay after another consecutive failure.
+// Must be called with l.mu held.
+func (l *rateLimiter) backoff() time.Duration {
+	l.failures++
+	return backoffDelay(l.failures)
+}
+
+func (l *rateLimiter) parseHeaders(header http.Header, now time.Time) {
+	ruleNames := header.Get("X-Rate-Limit-Rules")
+	if ruleNames == "" {
+		return
+	}
+
+	if policy := header.Get("X-Rate-Limit-Policy"); policy != l.policy {
+		fmt.Printf("Rate limit policy: %s (rules: %s)\n", policy, ruleNames)
+		l.policy = policy
+	}
+	rules := make(map[string][]rateLimitRule)
+	for _, name := range strings.Split(ruleNames, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		limits := parseRateLimitTriples(header.Get("X-Rate-Limit-" + name))
+		states := parseRateLimitTriples(header.Get("X-Rate-Limit-" + name + "-State"))
+		for i, limit := range limits {
+			rule := rateLimitRule{
+				Hits:        limit[0],
+				Period:      time.Duration(limit[1]) * time.Second,
+				Restriction: time.Duration(limit[2]) * time.Second,
+			}
+			if i < len(states) {
+				rule.CurrentHits = states[i][0]
+				rule.Restricted = time.Duration(states[i][2]) * time.Second
+			}
+
+			// The API counts requests we can't see (e.g. from other clients on the same
+			// IP), so trust its view of the state over our own.
+			if rule.Restricted > 0 {
+				l.blockUntil(now.Add(rule.Restricted))
+			} else if rule.Hits > 0 && rule.CurrentHits >= rule.Hits {
+				l.blockUntil(now.Add(rule.Period))
+			}
+			rules[name] = append(rules[name], rule)
+		}
+	}
+	l.rules = rules
+}
+
+// parseRateLimitTriples parses a header value like "45:60:120,240:240:900"
+func parseRateLimitTriples(value string) [][3]int {
+	var out [][3]int
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			continue
+		}
+
+		var triple [3]int
+		valid := true
+		for i, field := range fields {
+			n, err := strconv.Atoi(field)
+			if err != nil {
+				valid = false
+				break
+			}
+			triple[i] = n
+		}
+		if valid {
+			out = append(out, triple)
+		}
+	}
+	return out
+}
+
+// parseRetryAfter handles both the delay-seconds and HTTP-date forms of Retry-After
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterHeaders(t *testing.T) {
+	limiter := newRateLimiter()
+	header := http.Header{}
+	header.Set("X-Rate-Limit-Policy", "public-stash-tabs-request-limit")
+	header.Set("X-Rate-Limit-Rules", "client")
+	header.Set("X-Rate-Limit-Client", "2:10:60")
+	header.Set("X-Rate-Limit-Client-State", "1:10:0")
+	limiter.Update(&http.Response{StatusCode: 200, Header: header})
+
+	require.Equal(t, []RateLimitBudget{{Rule: "client", Used: 1, Hits: 2, Period: 10 * time.Second}}, limiter.Budget())
+
+	// Two requests fill the window, so the third has to wait for the first to expire
+	now := time.Now()
+	limiter.history = []time.Time{now.Add(-4 * time.Second), now.Add(-time.Second)}
+	require.Equal(t, 6*time.Second, limiter.delay(now))
+
+	// Once the server reports we're restricted, wait out the restriction
+	header.Set("X-Rate-Limit-Client-State", "2:10:60")
+	limiter.Update(&http.Response{StatusCode: 200, Header: header})
+	require.InDelta(t, float64(60*time.Second), float64(limiter.delay(time.Now())), float64(time.Second))
+}
+
+func TestRateLimiterBudgetOrder(t *testing.T) {
+	limiter := newRateLimiter()
+	header := http.Header{}
+	header.Set("X-Rate-Limit-Rules", "Ip,Client")
+	header.Set("X-Rate-Limit-Ip", "30:300:60,8:10:60")
+	header.Set("X-Rate-Limit-Ip-State", "3:300:0,1:10:0")
+	header.Set("X-Rate-Limit-Client", "2:10:60")
+	header.Set("X-Rate-Limit-Client-State", "1:10:0")
+	limiter.Update(&http.Response{StatusCode: 200, Header: header})
+
+	require.Equal(t, []RateLimitBudget{
+		{Rule: "Client", Used: 1, Hits: 2, Period: 10 * time.Second},
+		{Rule: "Ip", Used: 1, Hits: 8, Period: 10 * time.Second},
+		{Rule: "Ip", Used: 3, Hits: 30, Period: 300 * time.Second},
+	}, limiter.Budget())
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	limiter := newRateLimiter()
+	header := http.Header{}
+	header.Set("Retry-After", "30")
+	limiter.Update(&http.Response{StatusCode: http.StatusTooManyRequests, Header: header})
+
+	require.InDelta(t, float64(30*time.Second), float64(limiter.delay(time.Now())), float64(time.Second))
+}
+
+func TestRateLimiterServerErrorBackoff(t *testing.T) {
+	limiter := newRateLimiter()
+	for i := 0; i < 3; i++ {
+		limiter.Update(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}})
+	}
+
+	delay := limiter.delay(time.Now())
+	require.True(t, delay >= 2*time.Second && delay <= 4*time.Second, "unexpected delay %v", delay)
+
+	limiter.Update(&http.Response{StatusCode: 200, Header: http.Header{}})
+	require.Equal(t, 0, limiter.failures)
+}
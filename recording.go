@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const recordingExt = ".json.gz"
+
+// A single page of the stash river as it was recorded, along with the change ID
+// that was requested to get it.
+type recordedPage struct {
+	ChangeID   string          `json:"change_id"`
+	RecordedAt time.Time       `json:"recorded_at"`
+	Page       json.RawMessage `json:"page"`
+}
+
+// Record raw pages from the stash river to compressed files in dir, continuing from
+// startID or the last recorded page if there is one. Recording stops once ctx is cancelled.
+func recordItems(ctx context.Context, client *http.Client, limiter *rateLimiter, tokens *tokenSource, dir, startID string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		panic(err)
+	}
+
+	files, err := listRecordings(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	// Pick up where the last recording left off
+	seq := len(files)
+	currentID := startID
+	if len(files) > 0 {
+		last, err := readRecording(files[len(files)-1])
+		if err != nil {
+			panic(err)
+		}
+		var page struct {
+			NextChangeID string `json:"next_change_id"`
+		}
+		if err := json.Unmarshal(last.Page, &page); err != nil {
+			panic(err)
+		}
+		currentID = page.NextChangeID
+		seq = recordingSeq(files[len(files)-1]) + 1
+	}
+
+	fmt.Printf("Recording to %s starting from change ID %q\n", dir, currentID)
+	for ctx.Err() == nil {
+		recordedAt := time.Now()
+		body, err := openStashPage(ctx, client, limiter, tokens, currentID)
+		if err != nil {
+			fmt.Printf("Error getting stashes: %v\n", err)
+			continue
+		}
+		raw, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			fmt.Printf("Error reading response body: %v\n", err)
+			continue
+		}
+
+		var page struct {
+			NextChangeID string            `json:"next_change_id"`
+			Stashes      []json.RawMessage `json:"stashes"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			fmt.Printf("Error parsing json: %v\n", err)
+			continue
+		}
+
+		if len(page.Stashes) > 0 {
+			path := filepath.Join(dir, fmt.Sprintf("%08d%s", seq, recordingExt))
+			if err := writeRecording(path, recordedPage{ChangeID: currentID, RecordedAt: recordedAt, Page: raw}); err != nil {
+				panic(err)
+			}
+			fmt.Printf("Recorded %d stashes to %s\n", len(page.Stashes), path)
+			seq++
+		}
+
+		currentID = page.NextChangeID
+	}
+
+	fmt.Printf("Stopped recording at change ID %q\n", currentID)
+}
+
+// Feed recorded pages from dir through the pipeline. A speed of 1 replays pages at the
+// rate they were recorded, 2 at twice that rate, and so on; 0 replays as fast as the
+// pipeline can accept them. outputCh is closed once every page has been replayed or
+// ctx is cancelled.
+func replayItems(ctx context.Context, dir string, speed float64, outputCh chan itemUpdate) {
+	defer close(outputCh)
+
+	files, err := listRecordings(dir)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Replaying %d pages from %s\n", len(files), dir)
+	var lastRecorded time.Time
+	for _, path := range files {
+		rec, err := readRecording(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", path, err)
+			continue
+		}
+
+		if speed > 0 && !lastRecorded.IsZero() {
+			select {
+			case <-time.After(time.Duration(float64(rec.RecordedAt.Sub(lastRecorded)) / speed)):
+			case <-ctx.Done():
+				fmt.Println(">>> Stopped replaying recorded pages")
+				return
+			}
+		}
+		lastRecorded = rec.RecordedAt
+
+		page, err := decodeStashPage(bytes.NewReader(rec.Page), trackedLeague)
+		if err != nil {
+			fmt.Printf("Error parsing %s: %v\n", path, err)
+			continue
+		}
+
+		fmt.Printf("Replaying %v stashes (%d skipped) from %s\n", len(page.Stashes), page.Skipped, path)
+		if len(page.Stashes) == 0 {
+			continue
+		}
+		select {
+		case outputCh <- itemUpdate{changeID: page.NextChangeID, time: rec.RecordedAt, stashes: page.Stashes}:
+		case <-ctx.Done():
+			fmt.Println(">>> Stopped replaying recorded pages")
+			return
+		}
+	}
+
+	fmt.Println(">>> Finished replaying recorded pages")
+}
+
+func writeRecording(path string, rec recordedPage) error {
+	// Write to a temp file first so a crash can't leave a truncated recording behind
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(f)
+	if err := json.NewEncoder(gz).Encode(rec); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func readRecording(path string) (*recordedPage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var rec recordedPage
+	if err := json.NewDecoder(gz).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// listRecordings returns the recorded pages in dir in the order they were recorded
+func listRecordings(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+recordingExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return recordingSeq(files[i]) < recordingSeq(files[j])
+	})
+	return files, nil
+}
+
+func recordingSeq(path string) int {
+	seq, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), recordingExt))
+	return seq
+}
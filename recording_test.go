@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	page := `{"next_change_id":"2-2-2","stashes":[{"id":"stash1","league":"Archnemesis","items":[` + itemJSON + `]}]}`
+	rec := recordedPage{ChangeID: "1-1-1", RecordedAt: time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC), Page: []byte(page)}
+	require.NoError(t, writeRecording(filepath.Join(dir, "00000000"+recordingExt), rec))
+
+	files, err := listRecordings(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	outputCh := make(chan itemUpdate, 1)
+	replayItems(context.Background(), dir, 0, outputCh)
+
+	update := <-outputCh
+	require.Equal(t, "2-2-2", update.changeID)
+	require.True(t, rec.RecordedAt.Equal(update.time))
+	require.Len(t, update.stashes, 1)
+	require.Equal(t, "stash1", update.stashes[0].ID)
+	require.Equal(t, "Rapture Nock", update.stashes[0].Items[0].Name)
+
+	// The channel is closed once the recording runs out
+	_, ok := <-outputCh
+	require.False(t, ok)
+}
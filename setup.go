@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"io/ioutil"
-	"strings"
+	"sync"
 )
 
 const stashIndexMapping = `{
@@ -12,25 +12,49 @@ const stashIndexMapping = `{
   }
 }`
 
-func setupIndexes() {
+// Item indexes that are known to exist, so we only check for each one once
+var (
+	createdIndexesLock sync.Mutex
+	createdIndexes     = make(map[string]bool)
+)
+
+func setupIndexes() error {
 	err := doElasticsearchRequest("GET", mappingIndex, nil, nil)
-	if err != nil && strings.Contains(err.Error(), "404") {
+	if isNotFound(err) {
 		body := bytes.NewBufferString(stashIndexMapping)
 		if err := doElasticsearchRequest("PUT", mappingIndex, body, nil); err != nil {
-			panic(err)
+			return err
 		}
+	} else if err != nil {
+		return err
 	}
+	return nil
+}
+
+// ensureItemIndex creates the item index for a league if it doesn't exist yet
+func ensureItemIndex(league string) error {
+	itemIndex := itemIndexName(league)
 
-	itemIndex := itemIndexPrefix + "-archnemesis"
-	err = doElasticsearchRequest("GET", itemIndex, nil, nil)
-	if err != nil && strings.Contains(err.Error(), "404") {
+	createdIndexesLock.Lock()
+	defer createdIndexesLock.Unlock()
+	if createdIndexes[itemIndex] {
+		return nil
+	}
+
+	err := doElasticsearchRequest("GET", itemIndex, nil, nil)
+	if isNotFound(err) {
 		b, err := ioutil.ReadFile("item_index_mapping.json")
 		if err != nil {
-			panic(err)
+			return err
 		}
 		body := bytes.NewBuffer(b)
 		if err := doElasticsearchRequest("PUT", itemIndex, body, nil); err != nil {
-			panic(err)
+			return err
 		}
+	} else if err != nil {
+		return err
 	}
+
+	createdIndexes[itemIndex] = true
+	return nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupIndexes(t *testing.T) {
+	status := http.StatusNotFound
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	ESURL = server.URL + "/"
+
+	// A missing index is created
+	require.NoError(t, setupIndexes())
+	require.Equal(t, 1, puts)
+
+	// Other errors stop startup rather than carrying on against a broken cluster
+	status = http.StatusUnauthorized
+	require.Error(t, setupIndexes())
+	require.Equal(t, 1, puts)
+}
+
+func TestElasticsearchChangeIDMissingIndex(t *testing.T) {
+	status := http.StatusNotFound
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	ESURL = server.URL + "/"
+	store := newElasticsearchStorage(server.Client())
+
+	// Nothing has been saved on a fresh cluster
+	changeID, err := store.ChangeID()
+	require.NoError(t, err)
+	require.Equal(t, "", changeID)
+
+	status = http.StatusInternalServerError
+	_, err = store.ChangeID()
+	require.Error(t, err)
+}
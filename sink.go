@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Sinks receive every batch once it's been persisted, set up in main
+var Sinks []batchSink
+
+// batchSink is an extra destination for persisted batches, e.g. an archive or an
+// event stream. Batches are written in the order they were persisted.
+type batchSink interface {
+	WriteBatch(batch persistedBatch) error
+	Close() error
+}
+
+// A batch of changes as it was written to storage
+type persistedBatch struct {
+	ChangeID string
+	Time     time.Time
+
+	// Stashes hold only their created and updated items, while ItemIDs lists
+	// everything that's in each stash
+	Stashes []PlayerStash
+	Deletes []itemRef
+	Cleared []stashRef
+}
+
+// writeToSinks passes a persisted batch on to each sink, retrying a sink that fails
+// with backoff so it doesn't miss the batch. Sinks that already took the batch aren't
+// written to again. It returns false if ctx is cancelled before every sink has it, in
+// which case the change ID mustn't be saved.
+func writeToSinks(ctx context.Context, batch persistedBatch) bool {
+	for _, sink := range Sinks {
+		sink := sink
+		what := fmt.Sprintf("writing batch %s to %T", batch.ChangeID, sink)
+		if !retryWithBackoff(ctx, what, func() error { return sink.WriteBatch(batch) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// withoutDeadLetters returns the batch without the items, removals and cleared stashes
+// whose writes were dead-lettered, so sinks only see what made it into storage
+func withoutDeadLetters(batch persistedBatch, deadLettered []storageOp) persistedBatch {
+	if len(deadLettered) == 0 {
+		return batch
+	}
+
+	items := make(map[itemRef]bool)
+	removals := make(map[itemRef]bool)
+	mappings := make(map[string]bool)
+	for _, op := range deadLettered {
+		switch op.kind() {
+		case opItem:
+			items[itemRef{ID: op.Item.ID, League: op.Item.League}] = true
+		case opRemoval:
+			removals[itemRef{ID: op.Removal.ID, League: op.Removal.League}] = true
+		case opStashMapping:
+			mappings[op.Mapping.StashID] = true
+		}
+	}
+
+	stashes := make([]PlayerStash, 0, len(batch.Stashes))
+	for _, stash := range batch.Stashes {
+		formatted := make([]*IndexedItem, 0, len(stash.FormattedItems))
+		for _, item := range stash.FormattedItems {
+			if !items[itemRef{ID: item.ID, League: stash.League}] {
+				formatted = append(formatted, item)
+			}
+		}
+		stash.FormattedItems = formatted
+		stashes = append(stashes, stash)
+	}
+	batch.Stashes = stashes
+
+	var deletes []itemRef
+	for _, ref := range batch.Deletes {
+		if !removals[ref] {
+			deletes = append(deletes, ref)
+		}
+	}
+	batch.Deletes = deletes
+
+	var cleared []stashRef
+	for _, ref := range batch.Cleared {
+		if !mappings[ref.ID] {
+			cleared = append(cleared, ref)
+		}
+	}
+	batch.Cleared = cleared
+
+	return batch
+}
+
+func closeSinks() {
+	for _, sink := range Sinks {
+		if err := sink.Close(); err != nil {
+			fmt.Printf("Error closing %T: %v\n", sink, err)
+		}
+	}
+}
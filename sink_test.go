@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingSink records the batches it's given, failing the first failures writes
+type countingSink struct {
+	failures int
+	batches  []persistedBatch
+}
+
+func (s *countingSink) WriteBatch(batch persistedBatch) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("sink unavailable")
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *countingSink) Close() error {
+	return nil
+}
+
+func TestWriteToSinksRetries(t *testing.T) {
+	ok := &countingSink{}
+	flaky := &countingSink{failures: 1}
+	Sinks = []batchSink{ok, flaky}
+	defer func() { Sinks = nil }()
+
+	require.True(t, writeToSinks(context.Background(), persistedBatch{ChangeID: "1-1-1"}))
+	require.Len(t, ok.batches, 1)
+	require.Len(t, flaky.batches, 1)
+
+	// Once shutting down, a failing sink holds the change ID back
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky.failures = 1
+	require.False(t, writeToSinks(ctx, persistedBatch{ChangeID: "1-1-2"}))
+	require.Len(t, flaky.batches, 1)
+}
+
+func TestWithoutDeadLetters(t *testing.T) {
+	stash := testStash(t, "item1", "item2")
+	batch := persistedBatch{
+		ChangeID: "1-1-1",
+		Stashes:  []PlayerStash{stash},
+		Deletes:  []itemRef{{ID: "item3", League: "Sentinel"}, {ID: "item4", League: "Sentinel"}},
+		Cleared:  []stashRef{{ID: "stash2", League: "Sentinel"}},
+	}
+
+	batch = withoutDeadLetters(batch, []storageOp{
+		{Item: &itemWrite{ID: "item2", League: "Sentinel"}},
+		{Removal: &itemRemoval{ID: "item3", League: "Sentinel"}},
+		{Mapping: &mappingWrite{StashID: "stash2"}},
+	})
+	require.Len(t, batch.Stashes, 1)
+	require.Len(t, batch.Stashes[0].FormattedItems, 1)
+	require.Equal(t, "item1", batch.Stashes[0].FormattedItems[0].ID)
+	require.Equal(t, []itemRef{{ID: "item4", League: "Sentinel"}}, batch.Deletes)
+	require.Empty(t, batch.Cleared)
+
+	// The stash the batch was built from is left alone
+	require.Len(t, stash.FormattedItems, 2)
+}
+
+func TestPersistItemLoopBatchTime(t *testing.T) {
+	Store = newMemoryStorage()
+	Fingerprints = nil
+	sink := &countingSink{}
+	Sinks = []batchSink{sink}
+	defer func() { Sinks = nil }()
+
+	// A replayed batch is dated when it was recorded, not when it's persisted
+	recordedAt := time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC)
+	inputCh, outputCh := make(chan itemUpdate, 1), make(chan string, 1)
+	inputCh <- itemUpdate{changeID: "1-1-1", time: recordedAt, stashes: []PlayerStash{testStash(t, "item1")}}
+	close(inputCh)
+	go persistItemLoop(context.Background(), inputCh, outputCh)
+	require.Equal(t, "1-1-1", <-outputCh)
+
+	require.Len(t, sink.batches, 1)
+	require.Equal(t, recordedAt, sink.batches[0].Time)
+	mappings, err := Store.LookupStashMappings([]string{"stash1"})
+	require.NoError(t, err)
+	require.Equal(t, "2022-05-20T00:00:00+0000", mappings["stash1"].LastUpdated)
+}
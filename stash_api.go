@@ -1,11 +1,15 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -34,28 +38,33 @@ type Item struct {
 	ItemCommon
 }
 
-func (i *Item) ToIndexedItem() *IndexedItem {
+// ToIndexedItem formats an item for indexing. tabName is the name of the stash tab the
+// item is in, which sets the price of any items without a price note of their own.
+func (i *Item) ToIndexedItem(tabName string) *IndexedItem {
 	out := &IndexedItem{
 		ItemCommon: i.ItemCommon,
 	}
 
 	// Pull out price data
-	matches := priceString.FindStringSubmatch(i.Note)
-	if matches == nil {
-		matches = priceString.FindStringSubmatch(i.InventoryID)
-	}
-	if matches != nil && len(matches) > 2 {
-		value, err := strconv.ParseFloat(matches[1], 64)
-		if err == nil {
-			out.PriceValue = JSONFloat(value)
-			out.PriceCurrency = matches[2]
-		} else if strings.Contains(matches[1], "/") {
-			parts := strings.SplitN(matches[1], "/", 2)
-			a, _ := strconv.ParseFloat(parts[0], 64)
-			b, _ := strconv.ParseFloat(parts[1], 64)
-			if b != 0 {
-				out.PriceValue = JSONFloat(a / b)
-				out.PriceCurrency = matches[2]
+	price, ok, err := parsePriceNote(i.Note)
+	if ok {
+		out.PriceSource = priceSourceNote
+	} else {
+		price, ok, err = parsePriceNote(tabName)
+		if ok {
+			out.PriceSource = priceSourceTab
+		}
+	}
+	if err != nil {
+		out.PriceError = err.Error()
+	} else if ok {
+		out.PriceType = price.Type
+		if price.Currency != "" {
+			out.PriceValue = JSONFloat(price.Value)
+			out.PriceCurrency = price.Currency
+			out.PricePerUnit = JSONFloat(price.PerUnit())
+			if price.Quantity != 1 {
+				out.PriceQuantity = JSONFloat(price.Quantity)
 			}
 		}
 	}
@@ -124,6 +133,10 @@ func (i *Item) ToIndexedItem() *IndexedItem {
 	out.ModCount.Veiled = len(out.VeiledMods)
 	out.ModCount.Utility = len(out.UtilityMods)
 
+	out.PseudoMods = computePseudoMods(out)
+	// Worked out before the properties are flattened, which rewrites their ranges
+	out.itemStats = computeItemStats(i.Properties, out)
+
 	flattenProperties := func(props Properties) map[string]interface{} {
 		out := make(map[string]interface{})
 		for _, prop := range props {
@@ -195,13 +208,42 @@ type IndexedItem struct {
 	LastUpdated string `json:"last_updated,omitempty"`
 	create      bool   `json:"-"`
 
+	// The item's price before this update, set when an existing item's price changed
+	prevPrice *itemPrice
+	// Whether anything other than the price changed on an update
+	contentChanged bool
+
+	// Hashes of the item's indexed fields, used to tell what changed between updates
+	ContentHash string `json:"content_hash,omitempty"`
+	PriceHash   string `json:"price_hash,omitempty"`
+
 	PriceValue    JSONFloat `json:"price_value,omitempty"`
 	PriceCurrency string    `json:"price_currency,omitempty"`
+	// How many items PriceValue pays for, if it isn't 1, e.g. 10 for a note of 3/10 chaos
+	PriceQuantity JSONFloat `json:"price_quantity,omitempty"`
+	PricePerUnit  JSONFloat `json:"price_per_unit,omitempty"`
+	PriceType     string    `json:"price_type,omitempty"`
+	PriceSource   string    `json:"price_source,omitempty"`
+	// Why the item's note couldn't be read as a price, if it couldn't
+	PriceError string `json:"price_error,omitempty"`
+	// The price in chaos at the exchange rates when the item was written. It isn't
+	// updated as the rates move, only when the item is written again.
+	PriceChaos JSONFloat `json:"price_chaos,omitempty"`
+
+	priceHistory
+
+	// When the item was removed and how many seconds it took to sell, set once it's
+	// removed. Writing the item again clears both.
+	RemovedAt  string `json:"removed_at,omitempty"`
+	TimeToSell int64  `json:"time_to_sell,omitempty"`
 
 	SocketCount int `json:"socketCount,omitempty"`
 	SocketLinks int `json:"socketLinks,omitempty"`
 
-	ModCount ModCounts `json:"modCount,omitempty"`
+	ModCount   ModCounts   `json:"modCount,omitempty"`
+	PseudoMods *PseudoMods `json:"pseudoMods,omitempty"`
+
+	itemStats
 
 	// Formatted fields
 	EnchantMods   []Modifier `json:"enchantMods,omitempty"`
@@ -221,6 +263,56 @@ type IndexedItem struct {
 	ItemCommon
 }
 
+// A listed price as it appears on an item
+type itemPrice struct {
+	Value    JSONFloat `json:"value"`
+	Currency string    `json:"currency"`
+}
+
+// A price an item was seen listed at, and when
+type pricePoint struct {
+	Value    JSONFloat `json:"value"`
+	Currency string    `json:"currency"`
+	Time     string    `json:"time"`
+}
+
+// Only the most recent prices are kept on an item, so relisting something over and
+// over doesn't grow its document without bound
+const maxPriceHistory = 50
+
+// priceHistory tracks the prices an item has been listed at, carried over from its
+// stored document each time it's updated
+type priceHistory struct {
+	FirstPrice   *itemPrice   `json:"first_price,omitempty"`
+	LastPrice    *itemPrice   `json:"last_price,omitempty"`
+	RepriceCount int          `json:"reprice_count,omitempty"`
+	PriceHistory []pricePoint `json:"price_history,omitempty"`
+}
+
+// recordPrice adds the item's current price to its history, if it's priced and the
+// price differs from the last one seen
+func (item *IndexedItem) recordPrice(date string) {
+	if item.PriceCurrency == "" {
+		return
+	}
+	price := itemPrice{Value: item.PriceValue, Currency: item.PriceCurrency}
+	if item.LastPrice != nil && *item.LastPrice == price {
+		return
+	}
+
+	if item.FirstPrice == nil {
+		item.FirstPrice = &price
+	} else {
+		item.RepriceCount++
+	}
+	item.LastPrice = &price
+
+	item.PriceHistory = append(item.PriceHistory, pricePoint{Value: price.Value, Currency: price.Currency, Time: date})
+	if len(item.PriceHistory) > maxPriceHistory {
+		item.PriceHistory = item.PriceHistory[len(item.PriceHistory)-maxPriceHistory:]
+	}
+}
+
 type ModCounts struct {
 	Enchant   int `json:"enchant,omitempty"`
 	Implicit  int `json:"implicit,omitempty"`
@@ -367,6 +459,7 @@ type APIResponse struct {
 	ID           string `json:"-"`
 	NextChangeID string `json:"next_change_id"`
 	Stashes      []PlayerStash
+	Skipped      int `json:"-"`
 }
 
 type PlayerStash struct {
@@ -382,38 +475,210 @@ type PlayerStash struct {
 	League            string         `json:"league"`
 }
 
-func getNextStashes(client *http.Client, currentID string) (*APIResponse, error) {
-	start := time.Now()
-	req, err := http.NewRequest("GET", "http://api.pathofexile.com/public-stash-tabs?id="+currentID, nil)
+// openStashPage requests the page of the stash river starting at currentID and returns
+// its body for the caller to read and close.
+func openStashPage(ctx context.Context, client *http.Client, limiter *rateLimiter, tokens *tokenSource, currentID string) (io.ReadCloser, error) {
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", StashURL+"?id="+url.QueryEscape(currentID), nil)
 	if err != nil {
 		fmt.Printf("Error creating request: %v\n", err)
 		return nil, err
 	}
+	if err := authorize(req, tokens); err != nil {
+		limiter.Failure()
+		fmt.Printf("Error getting OAuth token: %v\n", err)
+		return nil, err
+	}
+
+	// Setting this ourselves stops the transport from transparently decompressing
+	// the body, so we have to do that below
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	response, err := client.Do(req)
 	if err != nil {
-		response.Body.Close()
+		limiter.Failure()
 		fmt.Printf("Error getting request: %v\n", err)
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	bytes, err := ioutil.ReadAll(response.Body)
+	limiter.Update(response)
+	if response.StatusCode == http.StatusUnauthorized && tokens != nil {
+		tokens.Invalidate()
+	}
+
+	body := response.Body
+	if response.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(response.Body)
+		if err != nil {
+			response.Body.Close()
+			fmt.Printf("Error decompressing response: %v\n", err)
+			return nil, err
+		}
+		body = gzipBody{Reader: gz, body: response.Body}
+	}
+
+	if response.StatusCode >= 400 {
+		defer body.Close()
+		errBody, _ := ioutil.ReadAll(body)
+		log.Printf("Error: status code %d", response.StatusCode)
+		log.Println("Response Body:", string(errBody))
+		return nil, fmt.Errorf("Unexpected status code %d", response.StatusCode)
+	}
+
+	return body, nil
+}
+
+// gzipBody closes both the gzip reader and the underlying response body
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipBody) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+func getNextStashes(ctx context.Context, client *http.Client, limiter *rateLimiter, tokens *tokenSource, currentID string) (*APIResponse, error) {
+	start := time.Now()
+	body, err := openStashPage(ctx, client, limiter, tokens, currentID)
 	if err != nil {
-		fmt.Printf("Error reading response body: %v\n", err)
 		return nil, err
 	}
+	defer body.Close()
 
-	var stashes APIResponse
-	err = json.Unmarshal(bytes, &stashes)
+	stashes, err := decodeStashPage(body, trackedLeague)
 	if err != nil {
 		log.Printf("Error parsing json: %v\n", err)
-		log.Printf("len: %v\n", len(bytes))
 		return nil, err
 	}
 
 	delta := time.Since(start)
-	fmt.Printf("Fetched %v stashes in %v\n", len(stashes.Stashes), delta)
+	fmt.Printf("Fetched %v stashes (%d skipped) in %v (rate limit budget: %v)\n", len(stashes.Stashes), stashes.Skipped, delta, limiter.Budget())
+
+	return stashes, nil
+}
+
+// decodeStashPage decodes a page of the stash river one stash at a time, dropping
+// stashes whose league isn't kept without decoding their items.
+func decodeStashPage(r io.Reader, keep func(league string) bool) (*APIResponse, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	page := &APIResponse{}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "next_change_id":
+			if err := dec.Decode(&page.NextChangeID); err != nil {
+				return nil, err
+			}
+		case "stashes":
+			if err := expectDelim(dec, '['); err != nil {
+				return nil, err
+			}
+			for dec.More() {
+				stash, ok, err := decodeStash(dec, keep)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					page.Skipped++
+					continue
+				}
+				page.Stashes = append(page.Stashes, *stash)
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return nil, err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, expectDelim(dec, '}')
+}
+
+func decodeStash(dec *json.Decoder, keep func(league string) bool) (*PlayerStash, bool, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, false, err
+	}
+
+	stash := &PlayerStash{}
+	leagueSeen := false
+	var deferredItems json.RawMessage
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+
+		var dest interface{}
+		switch key {
+		case "id":
+			dest = &stash.ID
+		case "accountName":
+			dest = &stash.AccountName
+		case "lastCharacterName":
+			dest = &stash.LastCharacterName
+		case "stash":
+			dest = &stash.Stash
+		case "stashType":
+			dest = &stash.StashType
+		case "public":
+			dest = &stash.Public
+		case "league":
+			dest = &stash.League
+			leagueSeen = true
+		case "items":
+			if leagueSeen && keep(stash.League) {
+				dest = &stash.Items
+			} else {
+				// Hold on to the raw items until we know whether the stash is kept
+				dest = &deferredItems
+			}
+		default:
+			dest = &json.RawMessage{}
+		}
+
+		if err := dec.Decode(dest); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, false, err
+	}
+
+	if !keep(stash.League) {
+		return nil, false, nil
+	}
+	if deferredItems != nil {
+		if err := json.Unmarshal(deferredItems, &stash.Items); err != nil {
+			return nil, false, err
+		}
+	}
+	return stash, true, nil
+}
 
-	return &stashes, err
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v but got %v", delim, token)
+	}
+	return nil
 }
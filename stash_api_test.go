@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -179,11 +180,19 @@ const itemJSON = `{
 const expectedIndexJSON = `{
 	"price_value": 15,
 	"price_currency": "chaos",
+	"price_per_unit": 15,
+	"price_type": "price",
+	"price_source": "note",
 	"socketCount": 6,
 	"socketLinks": 6,
 	"modCount": {
 		"explicit": 7
 	},
+	"dps": 507,
+	"pdps": 124.80,
+	"edps": 382.2,
+	"dps_q20": 517.11,
+	"pdps_q20": 134.91,
 	"explicitMods": [
 		{
 			"text": "+# to Level of Socketed Bow Gems",
@@ -305,8 +314,71 @@ func TestParseItem(t *testing.T) {
 	var item Item
 	require.NoError(t, json.Unmarshal([]byte(itemJSON), &item))
 
-	indexedItem := item.ToIndexedItem()
+	indexedItem := item.ToIndexedItem("Stash 1")
 	bytes, err := json.MarshalIndent(indexedItem, "", "\t")
 	require.NoError(t, err)
 	require.Equal(t, expectedIndexJSON, string(bytes))
 }
+
+func TestDecodeStashPage(t *testing.T) {
+	// stash2 lists its items before its league, so they can't be skipped until the
+	// whole stash has been read
+	page := `{
+		"next_change_id": "2-2-2",
+		"stashes": [
+			{"id": "stash1", "accountName": "a", "public": true, "league": "Standard", "items": [` + itemJSON + `]},
+			{"id": "stash2", "accountName": "b", "public": true, "items": [` + itemJSON + `], "league": "Standard"},
+			{"id": "stash3", "accountName": "c", "public": true, "stash": "~price 1 chaos", "league": "Archnemesis", "items": [` + itemJSON + `]},
+			{"id": "stash4", "accountName": "d", "public": false, "league": null, "items": []}
+		]
+	}`
+
+	resp, err := decodeStashPage(strings.NewReader(page), trackedLeague)
+	require.NoError(t, err)
+	require.Equal(t, "2-2-2", resp.NextChangeID)
+	require.Equal(t, 2, resp.Skipped)
+	require.Len(t, resp.Stashes, 2)
+
+	stash := resp.Stashes[0]
+	require.Equal(t, "stash3", stash.ID)
+	require.Equal(t, "c", stash.AccountName)
+	require.Equal(t, "~price 1 chaos", stash.Stash)
+	require.True(t, stash.Public)
+	require.Len(t, stash.Items, 1)
+	require.Equal(t, "Rapture Nock", stash.Items[0].Name)
+
+	require.Equal(t, "stash4", resp.Stashes[1].ID)
+	require.Empty(t, resp.Stashes[1].Items)
+}
+
+func TestTabPriceInheritance(t *testing.T) {
+	var item Item
+	require.NoError(t, json.Unmarshal([]byte(itemJSON), &item))
+
+	// The item's own note wins over the tab's price
+	indexed := item.ToIndexedItem("~b/o 5 div")
+	require.Equal(t, JSONFloat(15), indexed.PriceValue)
+	require.Equal(t, "chaos", indexed.PriceCurrency)
+	require.Equal(t, priceSourceNote, indexed.PriceSource)
+
+	// Items without a note take the tab's price
+	item.Note = ""
+	indexed = item.ToIndexedItem("~b/o 5 div")
+	require.Equal(t, JSONFloat(5), indexed.PriceValue)
+	require.Equal(t, "divine", indexed.PriceCurrency)
+	require.Equal(t, priceTypeBuyout, indexed.PriceType)
+	require.Equal(t, priceSourceTab, indexed.PriceSource)
+
+	// A tab that isn't priced leaves the item unpriced, whatever its inventory ID is
+	item.InventoryID = "~price 1 chaos"
+	indexed = item.ToIndexedItem("Stash 1")
+	require.Equal(t, "", indexed.PriceCurrency)
+	require.Equal(t, "", indexed.PriceSource)
+
+	// Skipping an item in a priced tab leaves it unpriced
+	item.Note = "~skip"
+	indexed = item.ToIndexedItem("~b/o 5 div")
+	require.Equal(t, "", indexed.PriceCurrency)
+	require.Equal(t, priceTypeSkip, indexed.PriceType)
+	require.Equal(t, priceSourceNote, indexed.PriceSource)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Store is the storage backend used by the indexer, set up in main
+var Store Storage
+
+// Storage is where the indexer keeps items, the stash mappings used to detect
+// removals, and its position in the stash river. The pipeline only talks to storage
+// through this interface, so each backend is free to lay out its data as it likes.
+type Storage interface {
+	// Setup creates anything the backend needs before the indexer starts, e.g. indexes or tables
+	Setup() error
+
+	// EnsureLeague prepares the backend to store items from a league. It's called before
+	// any of the league's items are written.
+	EnsureLeague(league string) error
+
+	// LookupItems returns the stored items that exist out of the given ones, with their IDs set
+	LookupItems(refs []itemRef) ([]IndexedItem, error)
+
+	// LookupStashMappings returns the stored mappings for the given stash IDs, keyed by
+	// stash ID. Stashes that haven't been seen before are left out.
+	LookupStashMappings(stashIDs []string) (map[string]StashMapping, error)
+
+	// UpsertItems creates or replaces items. Replacing an item clears its removal.
+	UpsertItems(items []itemWrite) ([]writeFailure, error)
+
+	// RemoveItems marks items as no longer listed. Removing an item that was never
+	// stored does nothing.
+	RemoveItems(removals []itemRemoval) ([]writeFailure, error)
+
+	// SaveStashMappings replaces the stored contents of stashes
+	SaveStashMappings(mappings []mappingWrite) ([]writeFailure, error)
+
+	// ChangeID returns the change ID to resume the stash river from, or "" if there isn't one
+	ChangeID() (string, error)
+
+	// SaveChangeID stores the change ID that the next start should resume from
+	SaveChangeID(changeID string) error
+
+	// ExchangeRates returns the stored currency exchange rates
+	ExchangeRates() ([]exchangeRate, error)
+
+	// SaveExchangeRates stores the latest exchange rates, replacing any stored for the
+	// same league and currency
+	SaveExchangeRates(rates []exchangeRate) error
+}
+
+// An item to create or replace, along with the fields backends keep outside its document
+type itemWrite struct {
+	ID          string          `json:"id"`
+	League      string          `json:"league"`
+	Account     string          `json:"account,omitempty"`
+	CreatedAt   string          `json:"created_at,omitempty"`
+	LastUpdated string          `json:"last_updated,omitempty"`
+	Doc         json.RawMessage `json:"doc"` // The indexed item, without its ID
+}
+
+// An item that's no longer listed
+type itemRemoval struct {
+	ID         string `json:"id"`
+	League     string `json:"league"`
+	RemovedAt  string `json:"removed_at"`
+	TimeToSell int64  `json:"time_to_sell,omitempty"` // 0 if it's not known when it was listed
+}
+
+// A stash's current contents, used to spot removed items
+type mappingWrite struct {
+	StashID string       `json:"stash_id"`
+	Mapping StashMapping `json:"mapping"`
+}
+
+// A write that storage didn't apply. Index is its position in the writes that were
+// passed in. Writes that aren't retryable were rejected outright, e.g. because their
+// document is malformed. The write methods return an error instead when the call failed
+// as a whole, in which case every write should be retried.
+type writeFailure struct {
+	Index     int
+	Retryable bool
+	Status    int
+	Error     writeError
+}
+
+// newStorage sets up the storage backend with the given name
+func newStorage(name string, client *http.Client) (Storage, error) {
+	switch name {
+	case "", "elasticsearch":
+		if ESURL == "" {
+			return nil, fmt.Errorf("ES_URL is not set")
+		}
+		return newElasticsearchStorage(client), nil
+	case "postgres":
+		url := os.Getenv("POSTGRES_URL")
+		if url == "" {
+			return nil, fmt.Errorf("POSTGRES_URL is not set")
+		}
+		return newPostgresStorage(url)
+	case "sqlite":
+		return newSQLiteStorage(getEnvDefault("SQLITE_PATH", "poe-indexer.db"))
+	case "memory":
+		return newMemoryStorage(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q, expected one of: elasticsearch, postgres, sqlite, memory", name)
+	}
+}
+
+// latestItemWrites keeps only the last write to each item, for backends that write
+// them with a single multi-row upsert, which can't touch a row twice
+func latestItemWrites(items []itemWrite) []itemWrite {
+	latest := make(map[itemRef]int, len(items))
+	for i, item := range items {
+		latest[itemRef{ID: item.ID, League: item.League}] = i
+	}
+
+	var writes []itemWrite
+	for i, item := range items {
+		if latest[itemRef{ID: item.ID, League: item.League}] == i {
+			writes = append(writes, item)
+		}
+	}
+	return writes
+}
+
+// latestMappingWrites keeps only the last write to each stash mapping
+func latestMappingWrites(mappings []mappingWrite) []mappingWrite {
+	latest := make(map[string]int, len(mappings))
+	for i, mapping := range mappings {
+		latest[mapping.StashID] = i
+	}
+
+	var writes []mappingWrite
+	for i, mapping := range mappings {
+		if latest[mapping.StashID] == i {
+			writes = append(writes, mapping)
+		}
+	}
+	return writes
+}
+
+// parseRemovals parses when each item was removed, failing the removals whose times
+// can't be parsed
+func parseRemovals(removals []itemRemoval) ([]itemRemoval, []time.Time, []writeFailure) {
+	var valid []itemRemoval
+	var times []time.Time
+	var failures []writeFailure
+	for i, removal := range removals {
+		removedAt, err := time.Parse(ESDateFormat, removal.RemovedAt)
+		if err != nil {
+			failures = append(failures, writeFailure{Index: i, Status: 400, Error: writeError{Type: "parse_exception", Reason: err.Error()}})
+			continue
+		}
+		valid = append(valid, removal)
+		times = append(times, removedAt)
+	}
+	return valid, times, failures
+}
+
+// parseOptionalDate parses a date in the format the indexer writes, or returns nil
+// if it's missing or malformed
+func parseOptionalDate(date string) *time.Time {
+	t, err := time.Parse(ESDateFormat, date)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// elasticsearchStorage keeps items in an index per league, stash mappings in their own
+// index and the change ID in a single document.
+type elasticsearchStorage struct {
+	client *http.Client
+}
+
+func newElasticsearchStorage(client *http.Client) *elasticsearchStorage {
+	return &elasticsearchStorage{client: client}
+}
+
+func (s *elasticsearchStorage) Setup() error {
+	return setupIndexes()
+}
+
+func (s *elasticsearchStorage) EnsureLeague(league string) error {
+	return ensureItemIndex(league)
+}
+
+func (s *elasticsearchStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	// Fetch the existing items from their league's index
+	body := &bytes.Buffer{}
+	body.WriteString(`{"docs": [`)
+	for i, ref := range refs {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		body.WriteString(fmt.Sprintf(`{"_index":"%s","_id":"%s"}`, itemIndexName(ref.League), ref.ID))
+	}
+	body.WriteString(`]}`)
+
+	rawBody := string(body.Bytes())
+	var items BulkItemResponse
+	if err := doElasticsearchRequest("GET", "_mget", body, &items); err != nil {
+		fmt.Println("Logging request body to existing_items_req.json")
+		os.WriteFile("existing_items_req.json", []byte(rawBody), 0644)
+		return nil, err
+	}
+
+	var foundItems []IndexedItem
+	for _, entry := range items.Docs {
+		if entry.Found {
+			entry.Source.ID = entry.ID
+			foundItems = append(foundItems, entry.Source)
+		}
+	}
+	return foundItems, nil
+}
+
+func (s *elasticsearchStorage) LookupStashMappings(stashIDs []string) (map[string]StashMapping, error) {
+	// Fetch stash mappings from db
+	body := &bytes.Buffer{}
+	body.WriteString(`{"ids": [`)
+	for i, id := range stashIDs {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		body.WriteString(fmt.Sprintf(`"%s"`, id))
+	}
+	body.WriteString(`]}`)
+
+	rawBody := string(body.Bytes())
+	var mappings StashMappingResponse
+	if err := doElasticsearchRequest("GET", mappingIndex+"/_mget", body, &mappings); err != nil {
+		fmt.Println("Logging request body to diff_req.json")
+		os.WriteFile("diff_req.json", []byte(rawBody), 0644)
+		return nil, err
+	}
+
+	found := make(map[string]StashMapping, len(mappings.Docs))
+	for _, doc := range mappings.Docs {
+		if doc.Found {
+			found[doc.ID] = StashMapping{LastUpdated: doc.Source.LastUpdated, League: doc.Source.League, ItemIDs: doc.Source.ItemIDs}
+		}
+	}
+	return found, nil
+}
+
+// An action in a _bulk request, along with its document
+type bulkAction struct {
+	Action string
+	Index  string
+	ID     string
+	Doc    []byte
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Index  string      `json:"_index"`
+	ID     string      `json:"_id"`
+	Status int         `json:"status"`
+	Error  *writeError `json:"error,omitempty"`
+}
+
+// retryable reports whether a failed item might succeed if it's resubmitted, e.g. when
+// ES rejected it because its queues were full
+func (r bulkItemResult) retryable() bool {
+	return r.Status == http.StatusTooManyRequests || r.Status >= 500
+}
+
+// The fields a removal sets on an item's document
+type removalDoc struct {
+	RemovedAt  string `json:"removed_at"`
+	TimeToSell int64  `json:"time_to_sell,omitempty"`
+}
+
+func (s *elasticsearchStorage) UpsertItems(items []itemWrite) ([]writeFailure, error) {
+	actions := make([]bulkAction, 0, len(items))
+	for _, item := range items {
+		actions = append(actions, bulkAction{Action: "index", Index: itemIndexName(item.League), ID: item.ID, Doc: item.Doc})
+	}
+	return s.bulk(actions)
+}
+
+// RemoveItems sets removed_at on each item with a partial update
+func (s *elasticsearchStorage) RemoveItems(removals []itemRemoval) ([]writeFailure, error) {
+	actions := make([]bulkAction, 0, len(removals))
+	for _, removal := range removals {
+		doc, _ := json.Marshal(map[string]removalDoc{"doc": {RemovedAt: removal.RemovedAt, TimeToSell: removal.TimeToSell}})
+		actions = append(actions, bulkAction{Action: "update", Index: itemIndexName(removal.League), ID: removal.ID, Doc: doc})
+	}
+	return s.bulk(actions)
+}
+
+func (s *elasticsearchStorage) SaveStashMappings(mappings []mappingWrite) ([]writeFailure, error) {
+	actions := make([]bulkAction, 0, len(mappings))
+	for _, mapping := range mappings {
+		doc, _ := json.Marshal(mapping.Mapping)
+		actions = append(actions, bulkAction{Action: "index", Index: mappingIndex, ID: mapping.StashID, Doc: doc})
+	}
+	return s.bulk(actions)
+}
+
+// buildBulkBody formats bulk actions as an NDJSON _bulk request body
+func buildBulkBody(actions []bulkAction) []byte {
+	body := &bytes.Buffer{}
+	for _, action := range actions {
+		body.WriteString(fmt.Sprintf(`{"%s":{"_index":"%s","_id":"%s"}}`+"\n", action.Action, action.Index, action.ID))
+		body.Write(action.Doc)
+		body.WriteString("\n")
+	}
+	return body.Bytes()
+}
+
+// bulk sends the actions as a single _bulk request and returns the ones that failed
+func (s *elasticsearchStorage) bulk(actions []bulkAction) ([]writeFailure, error) {
+	body := buildBulkBody(actions)
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", ESURL+"_bulk?_source=false&filter_path=errors,items.*.status,items.*.error", compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	setBasicAuth(req)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		fmt.Printf("Error: status code %d\n", resp.StatusCode)
+		fmt.Printf("Headers: %v\n", resp.Header)
+		fmt.Println("Response Body:", string(respBody))
+		return nil, fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(actions) {
+		return nil, fmt.Errorf("bulk response has %d items for %d actions", len(result.Items), len(actions))
+	}
+
+	// Results come back in the same order as the actions in the request
+	var failures []writeFailure
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Error == nil:
+			case r.Error.Type == "document_missing_exception":
+				// Removal of an item we never indexed, nothing to do
+			default:
+				failures = append(failures, writeFailure{Index: i, Retryable: r.retryable(), Status: r.Status, Error: *r.Error})
+			}
+		}
+	}
+	return failures, nil
+}
+
+func (s *elasticsearchStorage) ChangeID() (string, error) {
+	return getChangeID()
+}
+
+func (s *elasticsearchStorage) SaveChangeID(changeID string) error {
+	return persistChangeID(s.client, changeID)
+}
+
+const exchangeRateIndex = "exchange-rates"
+
+func (s *elasticsearchStorage) ExchangeRates() ([]exchangeRate, error) {
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source exchangeRate `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err := doElasticsearchRequest("GET", exchangeRateIndex+"/_search?size=10000", nil, &result)
+	if isNotFound(err) {
+		// Nothing has been saved yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	rates := make([]exchangeRate, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		rates = append(rates, hit.Source)
+	}
+	return rates, nil
+}
+
+// SaveExchangeRates indexes a document per league and currency
+func (s *elasticsearchStorage) SaveExchangeRates(rates []exchangeRate) error {
+	body := &bytes.Buffer{}
+	for _, rate := range rates {
+		id, _ := json.Marshal(rate.League + "/" + rate.Currency)
+		doc, _ := json.Marshal(rate)
+		body.WriteString(fmt.Sprintf(`{"index":{"_index":"%s","_id":%s}}`+"\n", exchangeRateIndex, id))
+		body.Write(doc)
+		body.WriteString("\n")
+	}
+
+	var result bulkResponse
+	if err := doElasticsearchRequest("POST", "_bulk", body, &result); err != nil {
+		return err
+	}
+	if result.Errors {
+		return fmt.Errorf("some exchange rates failed to save")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// memoryStorage keeps everything in maps, for tests and trying out the pipeline
+// without any external services. Nothing survives a restart.
+type memoryStorage struct {
+	mu       sync.Mutex
+	items    map[itemRef]json.RawMessage
+	mappings map[string]StashMapping
+	rates    map[rateKey]exchangeRate
+	changeID string
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		items:    make(map[itemRef]json.RawMessage),
+		mappings: make(map[string]StashMapping),
+		rates:    make(map[rateKey]exchangeRate),
+	}
+}
+
+func (s *memoryStorage) Setup() error {
+	return nil
+}
+
+func (s *memoryStorage) EnsureLeague(league string) error {
+	return nil
+}
+
+func (s *memoryStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []IndexedItem
+	for _, ref := range refs {
+		doc, ok := s.items[ref]
+		if !ok {
+			continue
+		}
+		var item IndexedItem
+		if err := json.Unmarshal(doc, &item); err != nil {
+			return nil, err
+		}
+		item.ID = ref.ID
+		found = append(found, item)
+	}
+	return found, nil
+}
+
+func (s *memoryStorage) LookupStashMappings(stashIDs []string) (map[string]StashMapping, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := make(map[string]StashMapping, len(stashIDs))
+	for _, id := range stashIDs {
+		if mapping, ok := s.mappings[id]; ok {
+			found[id] = mapping
+		}
+	}
+	return found, nil
+}
+
+func (s *memoryStorage) UpsertItems(items []itemWrite) ([]writeFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, item := range items {
+		s.items[itemRef{ID: item.ID, League: item.League}] = item.Doc
+	}
+	return nil, nil
+}
+
+func (s *memoryStorage) RemoveItems(removals []itemRemoval) ([]writeFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failures []writeFailure
+	for i, removal := range removals {
+		// Like ES, removing an item that was never stored is a no-op
+		ref := itemRef{ID: removal.ID, League: removal.League}
+		doc, ok := s.items[ref]
+		if !ok {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(doc, &fields); err != nil {
+			failures = append(failures, writeFailure{Index: i, Status: 400, Error: writeError{Type: "parse_exception", Reason: err.Error()}})
+			continue
+		}
+		fields["removed_at"], _ = json.Marshal(removal.RemovedAt)
+		if removal.TimeToSell > 0 {
+			fields["time_to_sell"], _ = json.Marshal(removal.TimeToSell)
+		}
+		s.items[ref], _ = json.Marshal(fields)
+	}
+	return failures, nil
+}
+
+func (s *memoryStorage) SaveStashMappings(mappings []mappingWrite) ([]writeFailure, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mapping := range mappings {
+		s.mappings[mapping.StashID] = mapping.Mapping
+	}
+	return nil, nil
+}
+
+func (s *memoryStorage) ChangeID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.changeID, nil
+}
+
+func (s *memoryStorage) SaveChangeID(changeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changeID = changeID
+	return nil
+}
+
+func (s *memoryStorage) ExchangeRates() ([]exchangeRate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rates := make([]exchangeRate, 0, len(s.rates))
+	for _, rate := range s.rates {
+		rates = append(rates, rate)
+	}
+	return rates, nil
+}
+
+func (s *memoryStorage) SaveExchangeRates(rates []exchangeRate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rate := range rates {
+		s.rates[rateKey{League: rate.League, Currency: rate.Currency}] = rate
+	}
+	return nil
+}
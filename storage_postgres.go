@@ -0,0 +1,422 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS items (
+	league       TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	account      TEXT,
+	created_at   TIMESTAMPTZ,
+	last_updated TIMESTAMPTZ,
+	removed_at   TIMESTAMPTZ,
+	doc          JSONB NOT NULL,
+	PRIMARY KEY (league, id)
+);
+CREATE INDEX IF NOT EXISTS items_removed_at ON items (league, removed_at);
+CREATE INDEX IF NOT EXISTS items_doc ON items USING GIN (doc jsonb_path_ops);
+
+CREATE TABLE IF NOT EXISTS stash_mappings (
+	id           TEXT PRIMARY KEY,
+	league       TEXT,
+	last_updated TIMESTAMPTZ,
+	item_ids     TEXT[] NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS change_id (
+	id             INT PRIMARY KEY,
+	next_change_id TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS exchange_rates (
+	league     TEXT NOT NULL,
+	currency   TEXT NOT NULL,
+	chaos      DOUBLE PRECISION NOT NULL,
+	samples    INT NOT NULL,
+	updated_at TIMESTAMPTZ,
+	PRIMARY KEY (league, currency)
+);
+`
+
+// How many rows go into each multi-row insert, which keeps statements well under
+// Postgres' limit of 65535 parameters
+const postgresBatchRows = 500
+
+// postgresStorage keeps items in a single table keyed by league and item ID, with the
+// indexed item as a JSONB document alongside a few columns for the metadata that's
+// usually filtered on.
+type postgresStorage struct {
+	db *sql.DB
+}
+
+func newPostgresStorage(url string) (*postgresStorage, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStorage{db: db}, nil
+}
+
+func (s *postgresStorage) Setup() error {
+	_, err := s.db.Exec(postgresSchema)
+	return err
+}
+
+// Every league shares the items table, so there's nothing to set up
+func (s *postgresStorage) EnsureLeague(league string) error {
+	return nil
+}
+
+func (s *postgresStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	leagues := make([]string, 0, len(refs))
+	ids := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		leagues = append(leagues, ref.League)
+		ids = append(ids, ref.ID)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT items.id, items.removed_at, items.doc FROM items
+		JOIN unnest($1::text[], $2::text[]) AS refs (league, id)
+		ON items.league = refs.league AND items.id = refs.id`,
+		pq.Array(leagues), pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []IndexedItem
+	for rows.Next() {
+		var id string
+		var removedAt sql.NullTime
+		var doc []byte
+		if err := rows.Scan(&id, &removedAt, &doc); err != nil {
+			return nil, err
+		}
+		var item IndexedItem
+		if err := json.Unmarshal(doc, &item); err != nil {
+			return nil, err
+		}
+		item.ID = id
+		if removedAt.Valid {
+			item.RemovedAt = removedAt.Time.Format(ESDateFormat)
+		}
+		found = append(found, item)
+	}
+	return found, rows.Err()
+}
+
+func (s *postgresStorage) LookupStashMappings(stashIDs []string) (map[string]StashMapping, error) {
+	rows, err := s.db.Query(`SELECT id, league, last_updated, item_ids FROM stash_mappings WHERE id = ANY($1)`, pq.Array(stashIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]StashMapping, len(stashIDs))
+	for rows.Next() {
+		var id string
+		var league sql.NullString
+		var lastUpdated sql.NullTime
+		var mapping StashMapping
+		if err := rows.Scan(&id, &league, &lastUpdated, pq.Array(&mapping.ItemIDs)); err != nil {
+			return nil, err
+		}
+		mapping.League = league.String
+		if lastUpdated.Valid {
+			mapping.LastUpdated = lastUpdated.Time.Format(ESDateFormat)
+		}
+		found[id] = mapping
+	}
+	return found, rows.Err()
+}
+
+const postgresUpsertItemQuery = `INSERT INTO items (league, id, account, created_at, last_updated, doc) VALUES %s
+	ON CONFLICT (league, id) DO UPDATE SET
+		account = EXCLUDED.account,
+		created_at = COALESCE(EXCLUDED.created_at, items.created_at),
+		last_updated = EXCLUDED.last_updated,
+		removed_at = NULL,
+		doc = EXCLUDED.doc`
+
+const postgresRemoveItemsQuery = `
+	UPDATE items SET
+		removed_at = removals.removed_at,
+		doc = CASE WHEN removals.time_to_sell > 0
+			THEN jsonb_set(items.doc, '{time_to_sell}', to_jsonb(removals.time_to_sell))
+			ELSE items.doc END
+	FROM unnest($1::text[], $2::text[], $3::timestamptz[], $4::bigint[]) AS removals (league, id, removed_at, time_to_sell)
+	WHERE items.league = removals.league AND items.id = removals.id`
+
+func postgresItemArgs(item itemWrite) []interface{} {
+	return []interface{}{item.League, item.ID, item.Account, parseOptionalDate(item.CreatedAt), parseOptionalDate(item.LastUpdated), string(item.Doc)}
+}
+
+// UpsertItems writes the items in a single transaction using multi-row upserts.
+// Replacing an item's document clears removed_at, the same as reindexing it in ES. The
+// original created_at is kept when the new document doesn't have one.
+//
+// A row Postgres rejects, e.g. a document with a \u0000 that JSONB can't store, fails
+// the whole transaction, so the items are then written one at a time and only the
+// rejected ones are returned as failures.
+func (s *postgresStorage) UpsertItems(items []itemWrite) ([]writeFailure, error) {
+	err := s.upsertItemBatches(latestItemWrites(items))
+	if !postgresRejected(err) {
+		return nil, err
+	}
+
+	fmt.Printf("Postgres rejected a batch of %d items, writing them one at a time: %v\n", len(items), err)
+	var failures []writeFailure
+	for i, item := range items {
+		_, err := s.db.Exec(fmt.Sprintf(postgresUpsertItemQuery, postgresPlaceholders(1, 6)), postgresItemArgs(item)...)
+		if postgresRejected(err) {
+			failures = append(failures, postgresWriteFailure(i, err))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
+
+func (s *postgresStorage) upsertItemBatches(items []itemWrite) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(items); start += postgresBatchRows {
+		end := start + postgresBatchRows
+		if end > len(items) {
+			end = len(items)
+		}
+
+		args := make([]interface{}, 0, (end-start)*6)
+		for _, item := range items[start:end] {
+			args = append(args, postgresItemArgs(item)...)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(postgresUpsertItemQuery, postgresPlaceholders(end-start, 6)), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveItems marks the items as removed in a single transaction. Removals of items that
+// were never stored don't match any rows, like a missing document in ES. Like
+// UpsertItems, it falls back to a statement per removal if Postgres rejects a row.
+func (s *postgresStorage) RemoveItems(removals []itemRemoval) ([]writeFailure, error) {
+	valid, times, failures := parseRemovals(removals)
+	err := s.removeItemBatches(valid, times)
+	if !postgresRejected(err) {
+		return failures, err
+	}
+
+	fmt.Printf("Postgres rejected a batch of %d removals, writing them one at a time: %v\n", len(valid), err)
+	unparsed := make(map[int]bool, len(failures))
+	for _, failure := range failures {
+		unparsed[failure.Index] = true
+	}
+	next := 0
+	for i := range removals {
+		if unparsed[i] {
+			continue
+		}
+		_, err := s.db.Exec(postgresRemoveItemsQuery, postgresRemovalArgs(valid[next:next+1], times[next:next+1])...)
+		next++
+		if postgresRejected(err) {
+			failures = append(failures, postgresWriteFailure(i, err))
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(failures, func(a, b int) bool { return failures[a].Index < failures[b].Index })
+	return failures, nil
+}
+
+func (s *postgresStorage) removeItemBatches(removals []itemRemoval, times []time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(removals); start += postgresBatchRows {
+		end := start + postgresBatchRows
+		if end > len(removals) {
+			end = len(removals)
+		}
+		if _, err := tx.Exec(postgresRemoveItemsQuery, postgresRemovalArgs(removals[start:end], times[start:end])...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// postgresRemovalArgs builds the arrays that postgresRemoveItemsQuery unnests
+func postgresRemovalArgs(removals []itemRemoval, times []time.Time) []interface{} {
+	leagues := make([]string, 0, len(removals))
+	ids := make([]string, 0, len(removals))
+	removedAt := make([]string, 0, len(removals))
+	timesToSell := make([]int64, 0, len(removals))
+	for i, removal := range removals {
+		leagues = append(leagues, removal.League)
+		ids = append(ids, removal.ID)
+		removedAt = append(removedAt, times[i].Format(time.RFC3339))
+		timesToSell = append(timesToSell, removal.TimeToSell)
+	}
+	return []interface{}{pq.Array(leagues), pq.Array(ids), pq.Array(removedAt), pq.Array(timesToSell)}
+}
+
+// postgresRejected reports whether Postgres refused the data in a statement, as opposed
+// to the database being unavailable, which writing the rows again won't fix
+func postgresRejected(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	case "22", "23": // data exception, integrity constraint violation
+		return true
+	}
+	return false
+}
+
+func postgresWriteFailure(index int, err error) writeFailure {
+	pqErr := err.(*pq.Error)
+	return writeFailure{Index: index, Status: 400, Error: writeError{Type: pqErr.Code.Name(), Reason: pqErr.Message}}
+}
+
+func (s *postgresStorage) SaveStashMappings(mappings []mappingWrite) ([]writeFailure, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var args []interface{}
+	flush := func() error {
+		if len(args) == 0 {
+			return nil
+		}
+		query := `INSERT INTO stash_mappings (id, league, last_updated, item_ids) VALUES ` +
+			postgresPlaceholders(len(args)/4, 4) + `
+			ON CONFLICT (id) DO UPDATE SET
+				league = EXCLUDED.league,
+				last_updated = EXCLUDED.last_updated,
+				item_ids = EXCLUDED.item_ids`
+		_, err := tx.Exec(query, args...)
+		args = args[:0]
+		return err
+	}
+
+	for _, mapping := range latestMappingWrites(mappings) {
+		itemIDs := mapping.Mapping.ItemIDs
+		if itemIDs == nil {
+			itemIDs = []string{}
+		}
+		args = append(args, mapping.StashID, mapping.Mapping.League, parseOptionalDate(mapping.Mapping.LastUpdated), pq.Array(itemIDs))
+		if len(args)/4 >= postgresBatchRows {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return nil, tx.Commit()
+}
+
+func (s *postgresStorage) ChangeID() (string, error) {
+	var changeID string
+	err := s.db.QueryRow(`SELECT next_change_id FROM change_id WHERE id = 0`).Scan(&changeID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return changeID, err
+}
+
+func (s *postgresStorage) SaveChangeID(changeID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO change_id (id, next_change_id) VALUES (0, $1)
+		ON CONFLICT (id) DO UPDATE SET next_change_id = EXCLUDED.next_change_id`, changeID)
+	return err
+}
+
+func (s *postgresStorage) ExchangeRates() ([]exchangeRate, error) {
+	rows, err := s.db.Query(`SELECT league, currency, chaos, samples, updated_at FROM exchange_rates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []exchangeRate
+	for rows.Next() {
+		var rate exchangeRate
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&rate.League, &rate.Currency, &rate.Chaos, &rate.Samples, &updatedAt); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			rate.UpdatedAt = updatedAt.Time.Format(ESDateFormat)
+		}
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+func (s *postgresStorage) SaveExchangeRates(rates []exchangeRate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rate := range rates {
+		_, err := tx.Exec(`
+			INSERT INTO exchange_rates (league, currency, chaos, samples, updated_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (league, currency) DO UPDATE SET
+				chaos = EXCLUDED.chaos,
+				samples = EXCLUDED.samples,
+				updated_at = EXCLUDED.updated_at`,
+			rate.League, rate.Currency, rate.Chaos, rate.Samples, parseOptionalDate(rate.UpdatedAt))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// postgresPlaceholders returns the VALUES lists for a multi-row insert, e.g.
+// "($1, $2), ($3, $4)" for 2 rows of 2 columns
+func postgresPlaceholders(rows, columns int) string {
+	var b strings.Builder
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(")
+		for c := 0; c < columns; c++ {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			fmt.Fprintf(&b, "$%d", r*columns+c+1)
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresStorage(t *testing.T) {
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL is not set")
+	}
+
+	store, err := newPostgresStorage(url)
+	require.NoError(t, err)
+	_, err = store.db.Exec(`DROP TABLE IF EXISTS items, stash_mappings, change_id, exchange_rates`)
+	require.NoError(t, err)
+
+	testStorage(t, store, func(ref itemRef) string {
+		var removedAt sql.NullTime
+		require.NoError(t, store.db.QueryRow(`SELECT removed_at FROM items WHERE league = $1 AND id = $2`, ref.League, ref.ID).Scan(&removedAt))
+		if !removedAt.Valid {
+			return ""
+		}
+		return removedAt.Time.Format(time.RFC3339)
+	})
+
+	// JSONB can't store \u0000, which should only fail that item
+	failures, err := store.UpsertItems([]itemWrite{
+		{ID: "ok1", League: "Sentinel", Doc: []byte(`{"name":"a"}`)},
+		{ID: "bad", League: "Sentinel", Doc: []byte(`{"name":"a\u0000b"}`)},
+		{ID: "ok2", League: "Sentinel", Doc: []byte(`{"name":"b"}`)},
+	})
+	require.NoError(t, err)
+	require.Len(t, failures, 1)
+	require.Equal(t, 1, failures[0].Index)
+	require.False(t, failures[0].Retryable)
+	found, err := store.LookupItems([]itemRef{{League: "Sentinel", ID: "ok1"}, {League: "Sentinel", ID: "bad"}, {League: "Sentinel", ID: "ok2"}})
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+}
+
+func TestPostgresRejected(t *testing.T) {
+	require.True(t, postgresRejected(&pq.Error{Code: "22P05"}))
+	require.True(t, postgresRejected(&pq.Error{Code: "23505"}))
+	require.False(t, postgresRejected(&pq.Error{Code: "57P01"}))
+	require.False(t, postgresRejected(errors.New("connection refused")))
+	require.False(t, postgresRejected(nil))
+
+	failure := postgresWriteFailure(3, &pq.Error{Code: "22P05", Message: "unsupported Unicode escape sequence"})
+	require.Equal(t, writeFailure{Index: 3, Status: 400, Error: writeError{Type: "untranslatable_character", Reason: "unsupported Unicode escape sequence"}}, failure)
+}
+
+func TestPostgresPlaceholders(t *testing.T) {
+	require.Equal(t, "($1, $2, $3)", postgresPlaceholders(1, 3))
+	require.Equal(t, "($1, $2), ($3, $4), ($5, $6)", postgresPlaceholders(3, 2))
+}
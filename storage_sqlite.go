@@ -0,0 +1,381 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS items (
+	league       TEXT NOT NULL,
+	id           TEXT NOT NULL,
+	account      TEXT,
+	created_at   TIMESTAMP,
+	last_updated TIMESTAMP,
+	removed_at   TIMESTAMP,
+	doc          TEXT NOT NULL,
+	PRIMARY KEY (league, id)
+);
+CREATE INDEX IF NOT EXISTS items_removed_at ON items (league, removed_at);
+
+-- Full-text index over each item's mod text, keyed by the items table's rowid
+CREATE VIRTUAL TABLE IF NOT EXISTS item_mods USING fts4(mods);
+
+CREATE TABLE IF NOT EXISTS stash_mappings (
+	id           TEXT PRIMARY KEY,
+	league       TEXT,
+	last_updated TIMESTAMP,
+	item_ids     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS change_id (
+	id             INTEGER PRIMARY KEY,
+	next_change_id TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS exchange_rates (
+	league     TEXT NOT NULL,
+	currency   TEXT NOT NULL,
+	chaos      REAL NOT NULL,
+	samples    INTEGER NOT NULL,
+	updated_at TEXT,
+	PRIMARY KEY (league, currency)
+);
+`
+
+// How many items or stashes are looked up in each query, which keeps statements under
+// SQLite's limit on parameters
+const sqliteLookupRows = 400
+
+// sqliteStorage keeps everything in a single SQLite file, for running the indexer on
+// one machine without any other services. It's laid out like the Postgres backend,
+// with an FTS table for searching items by their mods.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+func newSQLiteStorage(path string) (*sqliteStorage, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer at a time, so writes from the persist workers
+	// take turns on a single connection rather than failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) Setup() error {
+	_, err := s.db.Exec(sqliteSchema)
+	return err
+}
+
+// Every league shares the items table, so there's nothing to set up
+func (s *sqliteStorage) EnsureLeague(league string) error {
+	return nil
+}
+
+func (s *sqliteStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	var found []IndexedItem
+	for start := 0; start < len(refs); start += sqliteLookupRows {
+		end := start + sqliteLookupRows
+		if end > len(refs) {
+			end = len(refs)
+		}
+
+		args := make([]interface{}, 0, 2*(end-start))
+		for _, ref := range refs[start:end] {
+			args = append(args, ref.League, ref.ID)
+		}
+		rows, err := s.db.Query(`SELECT id, removed_at, doc FROM items WHERE (league, id) IN (VALUES `+
+			sqlitePlaceholders(end-start, 2)+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var id, doc string
+			var removedAt sql.NullTime
+			if err := rows.Scan(&id, &removedAt, &doc); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			var item IndexedItem
+			if err := json.Unmarshal([]byte(doc), &item); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			item.ID = id
+			if removedAt.Valid {
+				item.RemovedAt = removedAt.Time.Format(ESDateFormat)
+			}
+			found = append(found, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+func (s *sqliteStorage) LookupStashMappings(stashIDs []string) (map[string]StashMapping, error) {
+	found := make(map[string]StashMapping, len(stashIDs))
+	for start := 0; start < len(stashIDs); start += sqliteLookupRows {
+		end := start + sqliteLookupRows
+		if end > len(stashIDs) {
+			end = len(stashIDs)
+		}
+
+		args := make([]interface{}, 0, end-start)
+		for _, id := range stashIDs[start:end] {
+			args = append(args, id)
+		}
+		rows, err := s.db.Query(`SELECT id, league, last_updated, item_ids FROM stash_mappings WHERE id IN (`+
+			strings.TrimSuffix(strings.Repeat("?, ", end-start), ", ")+`)`, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var id, itemIDs string
+			var league sql.NullString
+			var lastUpdated sql.NullTime
+			if err := rows.Scan(&id, &league, &lastUpdated, &itemIDs); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			mapping := StashMapping{League: league.String}
+			if lastUpdated.Valid {
+				mapping.LastUpdated = lastUpdated.Time.Format(ESDateFormat)
+			}
+			if err := json.Unmarshal([]byte(itemIDs), &mapping.ItemIDs); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[id] = mapping
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// sqlitePlaceholders returns the placeholders for rows of values in a query, e.g.
+// "(?, ?), (?, ?)"
+func sqlitePlaceholders(rows, columns int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", columns), ", ") + ")"
+	return strings.TrimSuffix(strings.Repeat(row+", ", rows), ", ")
+}
+
+// UpsertItems writes the items in a single transaction, keeping the full-text index
+// of their mods in step. Replacing an item's document clears removed_at, the same as
+// reindexing it in ES. The original created_at is kept when the new document doesn't
+// have one.
+func (s *sqliteStorage) UpsertItems(items []itemWrite) ([]writeFailure, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, item := range latestItemWrites(items) {
+		var rowID int64
+		err := tx.QueryRow(`
+			INSERT INTO items (league, id, account, created_at, last_updated, doc) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (league, id) DO UPDATE SET
+				account = excluded.account,
+				created_at = COALESCE(excluded.created_at, items.created_at),
+				last_updated = excluded.last_updated,
+				removed_at = NULL,
+				doc = excluded.doc
+			RETURNING rowid`,
+			item.League, item.ID, item.Account, parseOptionalDate(item.CreatedAt), parseOptionalDate(item.LastUpdated), string(item.Doc)).Scan(&rowID)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM item_mods WHERE docid = ?`, rowID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO item_mods (docid, mods) VALUES (?, ?)`, rowID, itemModText(item.Doc)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, tx.Commit()
+}
+
+// RemoveItems marks the items as removed in a single transaction. Removals of items that
+// were never stored don't match any rows, like a missing document in ES.
+func (s *sqliteStorage) RemoveItems(removals []itemRemoval) ([]writeFailure, error) {
+	removals, times, failures := parseRemovals(removals)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i, removal := range removals {
+		_, err := tx.Exec(`
+			UPDATE items SET
+				removed_at = ?,
+				doc = CASE WHEN ? > 0 THEN json_set(doc, '$.time_to_sell', ?) ELSE doc END
+			WHERE league = ? AND id = ?`,
+			times[i], removal.TimeToSell, removal.TimeToSell, removal.League, removal.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return failures, tx.Commit()
+}
+
+func (s *sqliteStorage) SaveStashMappings(mappings []mappingWrite) ([]writeFailure, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, mapping := range latestMappingWrites(mappings) {
+		itemIDs := mapping.Mapping.ItemIDs
+		if itemIDs == nil {
+			itemIDs = []string{}
+		}
+		itemIDsJSON, _ := json.Marshal(itemIDs)
+		_, err := tx.Exec(`
+			INSERT INTO stash_mappings (id, league, last_updated, item_ids) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				league = excluded.league,
+				last_updated = excluded.last_updated,
+				item_ids = excluded.item_ids`,
+			mapping.StashID, mapping.Mapping.League, parseOptionalDate(mapping.Mapping.LastUpdated), string(itemIDsJSON))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, tx.Commit()
+}
+
+// SearchMods returns the IDs of items in a league whose mods match an FTS query,
+// e.g. "maximum life" or "cold NEAR resistance"
+func (s *sqliteStorage) SearchMods(league, query string) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT items.id FROM item_mods
+		JOIN items ON items.rowid = item_mods.docid
+		WHERE item_mods MATCH ? AND items.league = ?`, query, league)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// searchItems prints the IDs of the items in a league whose mods match an FTS query,
+// for the search subcommand. Only the SQLite backend keeps a full-text index.
+func searchItems(w io.Writer, store Storage, league, query string) error {
+	sqlite, ok := store.(*sqliteStorage)
+	if !ok {
+		return fmt.Errorf("searching by mods needs STORAGE=sqlite")
+	}
+	ids, err := sqlite.SearchMods(league, query)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	return nil
+}
+
+func (s *sqliteStorage) ChangeID() (string, error) {
+	var changeID string
+	err := s.db.QueryRow(`SELECT next_change_id FROM change_id WHERE id = 0`).Scan(&changeID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return changeID, err
+}
+
+func (s *sqliteStorage) SaveChangeID(changeID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO change_id (id, next_change_id) VALUES (0, ?)
+		ON CONFLICT (id) DO UPDATE SET next_change_id = excluded.next_change_id`, changeID)
+	return err
+}
+
+func (s *sqliteStorage) ExchangeRates() ([]exchangeRate, error) {
+	rows, err := s.db.Query(`SELECT league, currency, chaos, samples, updated_at FROM exchange_rates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []exchangeRate
+	for rows.Next() {
+		var rate exchangeRate
+		var updatedAt sql.NullString
+		if err := rows.Scan(&rate.League, &rate.Currency, &rate.Chaos, &rate.Samples, &updatedAt); err != nil {
+			return nil, err
+		}
+		rate.UpdatedAt = updatedAt.String
+		rates = append(rates, rate)
+	}
+	return rates, rows.Err()
+}
+
+func (s *sqliteStorage) SaveExchangeRates(rates []exchangeRate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, rate := range rates {
+		_, err := tx.Exec(`
+			INSERT INTO exchange_rates (league, currency, chaos, samples, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (league, currency) DO UPDATE SET
+				chaos = excluded.chaos,
+				samples = excluded.samples,
+				updated_at = excluded.updated_at`,
+			rate.League, rate.Currency, rate.Chaos, rate.Samples, rate.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// itemModText joins the text of all of an item's mods, one per line, for full-text search
+func itemModText(doc []byte) string {
+	var item IndexedItem
+	if err := json.Unmarshal(doc, &item); err != nil {
+		return ""
+	}
+
+	var lines []string
+	for _, mods := range [][]Modifier{item.EnchantMods, item.ImplicitMods, item.FracturedMods, item.ExplicitMods, item.CraftedMods, item.VeiledMods, item.UtilityMods} {
+		for _, mod := range mods {
+			lines = append(lines, mod.Text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	store, err := newSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+
+	testStorage(t, store, func(ref itemRef) string {
+		var removedAt sql.NullString
+		require.NoError(t, store.db.QueryRow(`SELECT removed_at FROM items WHERE league = ? AND id = ?`, ref.League, ref.ID).Scan(&removedAt))
+		return removedAt.String
+	})
+
+	// Lookups bigger than a single query are split up
+	refs := []itemRef{{ID: "item1", League: "Sentinel"}}
+	stashIDs := []string{"stash1"}
+	for i := 0; i < 2*sqliteLookupRows; i++ {
+		refs = append(refs, itemRef{ID: fmt.Sprintf("missing%d", i), League: "Sentinel"})
+		stashIDs = append(stashIDs, fmt.Sprintf("missing%d", i))
+	}
+	refs = append(refs, itemRef{ID: "item2", League: "Sentinel"}, itemRef{ID: "item1", League: "Standard"})
+	items, err := store.LookupItems(refs)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	mappings, err := store.LookupStashMappings(append(stashIDs, "stash1"))
+	require.NoError(t, err)
+	require.Len(t, mappings, 1)
+
+	ids, err := store.SearchMods("Sentinel", `"Lightning Damage"`)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"item1", "item2"}, ids)
+
+	ids, err = store.SearchMods("Sentinel", "maximum life")
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	ids, err = store.SearchMods("Standard", "bleeding")
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, searchItems(out, store, "Sentinel", `"Lightning Damage"`))
+	require.ElementsMatch(t, []string{"item1", "item2"}, strings.Fields(out.String()))
+	require.Error(t, searchItems(out, newMemoryStorage(), "Sentinel", "life"))
+}
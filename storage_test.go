@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testStash(t *testing.T, itemIDs ...string) PlayerStash {
+	stash := PlayerStash{ID: "stash1", AccountName: "a", League: "Sentinel", Public: true}
+	for _, id := range itemIDs {
+		var item Item
+		require.NoError(t, json.Unmarshal([]byte(itemJSON), &item))
+		item.ID = id
+		stash.ItemIDs = append(stash.ItemIDs, id)
+		stash.FormattedItems = append(stash.FormattedItems, item.ToIndexedItem(stash.Stash))
+	}
+	return stash
+}
+
+// persistTestStashes runs stashes through the same steps as the pipeline, after formatting
+func persistTestStashes(t *testing.T, stashes []PlayerStash) itemUpdate {
+	filtered, fingerprints, err := compareExistingItems(stashes, time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	deletes, cleared, err := diffStashes(stashes)
+	require.NoError(t, err)
+	listedAt, err := lookupListedTimes(deletes)
+	require.NoError(t, err)
+
+	update := itemUpdate{stashes: filtered, deletes: deletes, cleared: cleared, listedAt: listedAt}
+	retry, deadLettered, err := persistItems("1-1-1", buildStorageOps(update, "2022-05-20T00:00:00+0000"))
+	require.NoError(t, err)
+	require.Empty(t, retry)
+	require.Empty(t, deadLettered)
+	commitFingerprints(fingerprints, deletes, deadLettered)
+	return update
+}
+
+// testStorage runs the create, no-op and removal flow against a backend. removedAt
+// returns when the backend recorded the item as removed.
+func testStorage(t *testing.T, store Storage, removedAt func(ref itemRef) string) {
+	Store = store
+	Fingerprints = nil
+	require.NoError(t, store.Setup())
+	require.NoError(t, store.EnsureLeague("Sentinel"))
+
+	changeID, err := store.ChangeID()
+	require.NoError(t, err)
+	require.Equal(t, "", changeID)
+
+	// New items are created along with the stash mapping
+	update := persistTestStashes(t, []PlayerStash{testStash(t, "item1", "item2")})
+	require.Len(t, update.stashes[0].FormattedItems, 2)
+	require.Empty(t, update.deletes)
+
+	mappings, err := store.LookupStashMappings([]string{"stash1", "stash2"})
+	require.NoError(t, err)
+	require.Len(t, mappings, 1)
+	require.Equal(t, "Sentinel", mappings["stash1"].League)
+	require.Equal(t, "2022-05-20T00:00:00+0000", mappings["stash1"].LastUpdated)
+	require.Equal(t, []string{"item1", "item2"}, mappings["stash1"].ItemIDs)
+
+	// Seeing the same items again is a no-op
+	update = persistTestStashes(t, []PlayerStash{testStash(t, "item1", "item2")})
+	require.Empty(t, update.stashes[0].FormattedItems)
+	require.Empty(t, update.deletes)
+
+	// Repricing an item adds to its price history
+	for _, price := range []JSONFloat{10, 8} {
+		stash := testStash(t, "item1", "item2")
+		stash.FormattedItems[0].PriceValue = price
+		stash.FormattedItems[0].PriceCurrency = "chaos"
+		update = persistTestStashes(t, []PlayerStash{stash})
+		require.Len(t, update.stashes[0].FormattedItems, 1)
+	}
+	items, err := store.LookupItems([]itemRef{{ID: "item1", League: "Sentinel"}})
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, &itemPrice{Value: 15, Currency: "chaos"}, items[0].FirstPrice)
+	require.Equal(t, &itemPrice{Value: 8, Currency: "chaos"}, items[0].LastPrice)
+	require.Equal(t, 2, items[0].RepriceCount)
+	require.Len(t, items[0].PriceHistory, 3)
+	require.NotEqual(t, "", items[0].CreatedAt)
+
+	// Items missing from the stash are marked as removed
+	update = persistTestStashes(t, []PlayerStash{testStash(t, "item1")})
+	require.Equal(t, []itemRef{{ID: "item2", League: "Sentinel"}}, update.deletes)
+	require.Equal(t, "", removedAt(itemRef{ID: "item1", League: "Sentinel"}))
+	require.NotEqual(t, "", removedAt(itemRef{ID: "item2", League: "Sentinel"}))
+
+	// A removed item that's listed again is relisted, even though it hasn't changed
+	update = persistTestStashes(t, []PlayerStash{testStash(t, "item1", "item2")})
+	require.Len(t, update.stashes[0].FormattedItems, 1)
+	require.Equal(t, "item2", update.stashes[0].FormattedItems[0].ID)
+	require.True(t, update.stashes[0].FormattedItems[0].create)
+	require.Equal(t, "", removedAt(itemRef{ID: "item2", League: "Sentinel"}))
+	persistTestStashes(t, []PlayerStash{testStash(t, "item1")})
+
+	items, err = store.LookupItems([]itemRef{{ID: "item1", League: "Sentinel"}, {ID: "item3", League: "Sentinel"}, {ID: "item1", League: "Standard"}})
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "item1", items[0].ID)
+	require.Equal(t, "Rapture Nock", items[0].Name)
+
+	rates, err := store.ExchangeRates()
+	require.NoError(t, err)
+	require.Empty(t, rates)
+	divine := exchangeRate{League: "Sentinel", Currency: "divine", Chaos: 200, Samples: 5, UpdatedAt: "2022-05-20T00:00:00+0000"}
+	require.NoError(t, store.SaveExchangeRates([]exchangeRate{divine}))
+	divine.Chaos = 210
+	require.NoError(t, store.SaveExchangeRates([]exchangeRate{divine}))
+	rates, err = store.ExchangeRates()
+	require.NoError(t, err)
+	require.Len(t, rates, 1)
+	require.Equal(t, 210.0, rates[0].Chaos)
+
+	require.NoError(t, store.SaveChangeID("2-2-2"))
+	require.NoError(t, store.SaveChangeID("3-3-3"))
+	changeID, err = store.ChangeID()
+	require.NoError(t, err)
+	require.Equal(t, "3-3-3", changeID)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	store := newMemoryStorage()
+	testStorage(t, store, func(ref itemRef) string {
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal(store.items[ref], &doc))
+		removedAt, _ := doc["removed_at"].(string)
+		return removedAt
+	})
+}
+
+// flakyStorage fails the first few lookups. Lookups run concurrently, so the count is
+// guarded by mu.
+type flakyStorage struct {
+	*memoryStorage
+
+	mu       sync.Mutex
+	failures int
+}
+
+// fail returns whether the next lookup should fail, counting it if it should
+func (s *flakyStorage) fail() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		return true
+	}
+	return false
+}
+
+func (s *flakyStorage) LookupItems(refs []itemRef) ([]IndexedItem, error) {
+	if s.fail() {
+		return nil, fmt.Errorf("lookup failed")
+	}
+	return s.memoryStorage.LookupItems(refs)
+}
+
+func (s *flakyStorage) LookupStashMappings(stashIDs []string) (map[string]StashMapping, error) {
+	if s.fail() {
+		return nil, fmt.Errorf("lookup failed")
+	}
+	return s.memoryStorage.LookupStashMappings(stashIDs)
+}
+
+func TestLookupFailuresAreRetried(t *testing.T) {
+	Fingerprints = nil
+
+	// A failed lookup doesn't treat every item as new
+	Store = &flakyStorage{memoryStorage: newMemoryStorage(), failures: 1}
+	_, _, err := compareExistingItems([]PlayerStash{testStash(t, "item1")}, time.Now())
+	require.Error(t, err)
+
+	// Batches are held until their diff succeeds rather than being dropped
+	Store = &flakyStorage{memoryStorage: newMemoryStorage(), failures: 1}
+	inputCh, outputCh := make(chan itemUpdate, 1), make(chan itemUpdate, 1)
+	go diffStashLoop(context.Background(), inputCh, outputCh)
+	inputCh <- itemUpdate{changeID: "1-1-1", stashes: []PlayerStash{testStash(t, "item1")}}
+	close(inputCh)
+	update := <-outputCh
+	require.Equal(t, "1-1-1", update.changeID)
+
+	// Once shutting down, the batch and everything after it are dropped instead
+	Store = &flakyStorage{memoryStorage: newMemoryStorage(), failures: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inputCh, outputCh = make(chan itemUpdate, 2), make(chan itemUpdate, 2)
+	inputCh <- itemUpdate{changeID: "1-1-1", stashes: []PlayerStash{testStash(t, "item1")}}
+	inputCh <- itemUpdate{changeID: "2-2-2", stashes: []PlayerStash{testStash(t, "item1")}}
+	close(inputCh)
+	diffStashLoop(ctx, inputCh, outputCh)
+	_, ok := <-outputCh
+	require.False(t, ok)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"time"
@@ -16,13 +18,16 @@ type StashMappingResponse struct {
 		ID     string `json:"_id"`
 		Found  bool   `json:"found"`
 		Source struct {
-			ItemIDs []string `json:"item_ids"`
+			LastUpdated string   `json:"last_updated"`
+			League      string   `json:"league"`
+			ItemIDs     []string `json:"item_ids"`
 		} `json:"_source"`
 	} `json:"docs"`
 }
 
 type StashMapping struct {
 	LastUpdated string   `json:"last_updated,omitempty"`
+	League      string   `json:"league,omitempty"`
 	ItemIDs     []string `json:"item_ids"`
 }
 
@@ -34,6 +39,46 @@ type BulkItemResponse struct {
 	} `json:"docs"`
 }
 
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 2 * time.Minute
+)
+
+// backoffDelay returns an exponentially increasing delay for the given attempt, with jitter
+func backoffDelay(attempt int) time.Duration {
+	d := minBackoff << uint(attempt-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryWithBackoff calls f until it succeeds, backing off between attempts. It gives
+// up and returns false once ctx is cancelled.
+func retryWithBackoff(ctx context.Context, what string, f func() error) bool {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return true
+		}
+
+		delay := backoffDelay(attempt)
+		fmt.Printf("Error %s, retrying in %v: %v\n", what, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func getEnvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func setBasicAuth(req *http.Request) {
 	user := os.Getenv("ES_USERNAME")
 	pass := os.Getenv("ES_PASSWORD")
@@ -73,7 +118,7 @@ func doElasticsearchRequest(method, path string, body io.Reader, out interface{}
 		}
 
 		log.Println("Response Body:", string(body))
-		return fmt.Errorf("Unexpected status code %d", resp.StatusCode)
+		return esStatusError{StatusCode: resp.StatusCode}
 	}
 
 	if out != nil {
@@ -89,6 +134,23 @@ func doElasticsearchRequest(method, path string, body io.Reader, out interface{}
 	return nil
 }
 
+// An error status from Elasticsearch, so callers can tell e.g. a missing index apart
+// from other failures
+type esStatusError struct {
+	StatusCode int
+}
+
+func (e esStatusError) Error() string {
+	return fmt.Sprintf("Unexpected status code %d", e.StatusCode)
+}
+
+// isNotFound returns whether an Elasticsearch request failed because what it asked for
+// doesn't exist
+func isNotFound(err error) bool {
+	statusErr, ok := err.(esStatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
 func doDiscordRequest(body io.Reader) error {
 	client := &http.Client{
 		Timeout: 10 * time.Second,